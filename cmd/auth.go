@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// configureRegistryAuth adds the credentials from DOCKERLESS_REGISTRY_AUTH, --registry-auth-file,
+// --registry-auth and --registry-token in front of the default keychain. kaniko resolves the default
+// keychain on every pull and push, so this also covers base images and the registry cache.
+// The credentials are only kept in memory and are never printed or persisted.
+func (f *RegistryFlags) configureRegistryAuth() error {
+	keychain := registryKeychain{}
+
+	// the environment has the lowest priority
+	if registryAuth := os.Getenv("DOCKERLESS_REGISTRY_AUTH"); registryAuth != "" {
+		dockerConfig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(registryAuth))
+		if err != nil {
+			return fmt.Errorf("decode DOCKERLESS_REGISTRY_AUTH: %w", err)
+		}
+
+		err = keychain.addDockerConfig(bytes.NewReader(dockerConfig))
+		if err != nil {
+			return fmt.Errorf("parse DOCKERLESS_REGISTRY_AUTH: %w", err)
+		}
+	}
+
+	if f.RegistryAuthFile != "" {
+		file, err := os.Open(f.RegistryAuthFile)
+		if err != nil {
+			return fmt.Errorf("open registry auth file: %w", err)
+		}
+		defer file.Close()
+
+		err = keychain.addDockerConfig(file)
+		if err != nil {
+			return fmt.Errorf("parse registry auth file %s: %w", f.RegistryAuthFile, err)
+		}
+	}
+
+	// do not include the values in errors, as they contain secrets
+	for _, registryAuth := range f.RegistryAuths {
+		registry, userPassword, ok := strings.Cut(registryAuth, "=")
+		username, password, hasPassword := strings.Cut(userPassword, ":")
+		if !ok || registry == "" || !hasPassword || username == "" {
+			return errors.New("invalid --registry-auth: expected registry=user:password")
+		}
+
+		keychain[normalizeRegistry(registry)] = authn.AuthConfig{Username: username, Password: password}
+	}
+	for _, registryToken := range f.RegistryTokens {
+		registry, token, ok := strings.Cut(registryToken, "=")
+		if !ok || registry == "" || token == "" {
+			return errors.New("invalid --registry-token: expected registry=token")
+		}
+
+		keychain[normalizeRegistry(registry)] = authn.AuthConfig{RegistryToken: token}
+	}
+
+	if len(keychain) > 0 {
+		authn.DefaultKeychain = authn.NewMultiKeychain(keychain, authn.DefaultKeychain)
+	}
+
+	return nil
+}
+
+// registryKeychain resolves credentials by registry host
+type registryKeychain map[string]authn.AuthConfig
+
+func (k registryKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	authConfig, ok := k[normalizeRegistry(target.RegistryStr())]
+	if !ok {
+		return authn.Anonymous, nil
+	}
+
+	return authn.FromConfig(authConfig), nil
+}
+
+// addDockerConfig adds all credentials of a docker config.json
+func (k registryKeychain) addDockerConfig(reader io.Reader) error {
+	dockerConfig := configfile.New("")
+	err := dockerConfig.LoadFromReader(reader)
+	if err != nil {
+		return err
+	}
+
+	for registry, authConfig := range dockerConfig.GetAuthConfigs() {
+		k[normalizeRegistry(registry)] = authn.AuthConfig{
+			Username:      authConfig.Username,
+			Password:      authConfig.Password,
+			IdentityToken: authConfig.IdentityToken,
+			RegistryToken: authConfig.RegistryToken,
+		}
+	}
+
+	return nil
+}
+
+// normalizeRegistry turns registry keys such as https://index.docker.io/v1/ or docker.io into the registry host
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry, _, _ = strings.Cut(registry, "/")
+	if registry == "docker.io" || registry == "registry-1.docker.io" {
+		return name.DefaultRegistry
+	}
+
+	return registry
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestConfigureRegistryAuth(t *testing.T) {
+	defaultKeychain := authn.DefaultKeychain
+	defer func() {
+		authn.DefaultKeychain = defaultKeychain
+	}()
+
+	dockerConfig := func(user string, registries ...string) string {
+		auths := ""
+		for i, registry := range registries {
+			if i > 0 {
+				auths += ","
+			}
+			auths += `"` + registry + `":{"auth":"` + base64.StdEncoding.EncodeToString([]byte(user+":secret")) + `"}`
+		}
+		return `{"auths":{` + auths + `}}`
+	}
+
+	authFile := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, authFile, dockerConfig("file", "file.registry", "flag.registry"))
+	t.Setenv("DOCKERLESS_REGISTRY_AUTH", base64.StdEncoding.EncodeToString([]byte(dockerConfig("env", "https://index.docker.io/v1/", "file.registry"))))
+
+	flags := &RegistryFlags{
+		RegistryAuthFile: authFile,
+		RegistryAuths:    []string{"flag.registry=flag:secret"},
+		RegistryTokens:   []string{"token.registry=my-token"},
+	}
+	err := flags.configureRegistryAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image    string
+		username string
+		token    string
+	}{
+		{image: "ubuntu", username: "env"},
+		{image: "file.registry/app", username: "file"},
+		{image: "flag.registry/app", username: "flag"},
+		{image: "token.registry/app", token: "my-token"},
+	}
+	for _, test := range tests {
+		ref, err := name.ParseReference(test.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		authenticator, err := authn.DefaultKeychain.Resolve(ref.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		authConfig, err := authenticator.Authorization()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if authConfig.Username != test.username || authConfig.RegistryToken != test.token {
+			t.Errorf("%s: expected user %q and token %q, got %q and %q", test.image, test.username, test.token, authConfig.Username, authConfig.RegistryToken)
+		}
+	}
+}
+
+func TestConfigureRegistryAuthErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags RegistryFlags
+		env   string
+	}{
+		{name: "invalid base64", env: "not base64!"},
+		{name: "invalid docker config", env: base64.StdEncoding.EncodeToString([]byte("{"))},
+		{name: "missing file", flags: RegistryFlags{RegistryAuthFile: filepath.Join(t.TempDir(), "missing.json")}},
+		{name: "auth without password", flags: RegistryFlags{RegistryAuths: []string{"my.registry=user"}}},
+		{name: "auth without registry", flags: RegistryFlags{RegistryAuths: []string{"user:password"}}},
+		{name: "empty token", flags: RegistryFlags{RegistryTokens: []string{"my.registry="}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DOCKERLESS_REGISTRY_AUTH", test.env)
+
+			err := test.flags.configureRegistryAuth()
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestNormalizeRegistry(t *testing.T) {
+	tests := map[string]string{
+		"https://index.docker.io/v1/": name.DefaultRegistry,
+		"docker.io":                   name.DefaultRegistry,
+		"registry-1.docker.io":        name.DefaultRegistry,
+		"http://my.registry:5000/v2/": "my.registry:5000",
+		"ghcr.io":                     "ghcr.io",
+	}
+	for registry, want := range tests {
+		if got := normalizeRegistry(registry); got != want {
+			t.Errorf("%s: expected %s, got %s", registry, want, got)
+		}
+	}
+}
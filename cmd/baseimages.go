@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	image_util "github.com/GoogleContainerTools/kaniko/pkg/image"
+	"github.com/GoogleContainerTools/kaniko/pkg/image/remote"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// baseImageResolver retrieves every base image of a build only once, so planning, the fingerprint,
+// the disk space check and the reset of / share them. If an image cannot be retrieved, e.g. because
+// we are offline, the digest of the previous build can be used instead.
+type baseImageResolver struct {
+	opts     *config.KanikoOptions
+	previous *BuildFingerprint
+
+	images map[string]v1.Image
+	errs   map[string]error
+	warned map[string]bool
+}
+
+func newBaseImageResolver(opts *config.KanikoOptions, previous *BuildFingerprint) *baseImageResolver {
+	return &baseImageResolver{
+		opts:     opts,
+		previous: previous,
+		images:   map[string]v1.Image{},
+		errs:     map[string]error{},
+		warned:   map[string]bool{},
+	}
+}
+
+// stageImage returns the base image of a stage that is not built from another stage
+func (r *baseImageResolver) stageImage(stage config.KanikoStage) (v1.Image, error) {
+	return r.retrieve(stage.BaseName, func() (v1.Image, error) {
+		return image_util.RetrieveSourceImage(stage, r.opts)
+	})
+}
+
+// remoteImage returns an image that is referenced by COPY --from
+func (r *baseImageResolver) remoteImage(image string) (v1.Image, error) {
+	return r.retrieve(image, func() (v1.Image, error) {
+		return remote.RetrieveRemoteImage(image, r.opts.RegistryOptions, r.opts.CustomPlatform)
+	})
+}
+
+func (r *baseImageResolver) retrieve(name string, retrieve func() (v1.Image, error)) (v1.Image, error) {
+	if image, ok := r.images[name]; ok {
+		return image, nil
+	} else if err, ok := r.errs[name]; ok {
+		return nil, err
+	}
+
+	image, err := retrieve()
+	if err != nil {
+		r.errs[name] = err
+		return nil, err
+	}
+
+	r.images[name] = image
+	return image, nil
+}
+
+// previousDigest returns the digest the previous build used for an image that cannot be retrieved, if any
+func (r *baseImageResolver) previousDigest(name string, err error) string {
+	if r.previous == nil || r.previous.BaseImages[name] == "" {
+		return ""
+	}
+
+	if !r.warned[name] {
+		r.warned[name] = true
+		fmt.Printf("warning: using the digest of %s from the previous build, because it cannot be retrieved: %v\n", name, err)
+	}
+
+	return r.previous.BaseImages[name]
+}
@@ -1,16 +1,20 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/executor"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
-	"github.com/containerd/containerd/platforms"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -19,14 +23,44 @@ const defaultCacheDir = "/.dockerless/cache"
 var ImageConfigOutput = "/.dockerless/image.json"
 
 type BuildCmd struct {
-	Dockerfile    string
-	Context       string
-	Target        string
-	RegistryCache string
-	BuildArgs     []string
-	IgnorePaths   []string
-	Insecure      bool
-	ExportCache   bool
+	RegistryFlags
+
+	Devcontainer           string
+	Dockerfile             string
+	Context                string
+	Target                 string
+	RegistryCache          string
+	SharedCacheDir         string
+	OCILayoutPath          string
+	TarPath                string
+	DigestFile             string
+	ImageNameTagDigestFile string
+	Platform               string
+	SnapshotMode           string
+	Compression            config.Compression
+	CompressionLevel       int
+	CacheTTL               time.Duration
+	CacheMaxSize           string
+	BuildArgs              []string
+	BuildArgFiles          []string
+	Features               []string
+	Labels                 []string
+	IgnorePaths            []string
+	PersistPaths           []string
+	Destinations           []string
+	ExportCache            bool
+	ExplainCache           bool
+	SkipDiskSpaceCheck     bool
+	Force                  bool
+	DryRun                 bool
+	IKnowWhatIAmDoing      bool
+
+	cacheMaxSize          int64
+	sharedCacheDir        string
+	labels                map[string]string
+	ignorePaths           []util.IgnoreListEntry
+	devContainer          *DevContainerConfig
+	devContainerBuildArgs []string
 }
 
 // NewBuildCmd returns a new build command
@@ -38,56 +72,218 @@ func NewBuildCmd() *cobra.Command {
 		SilenceUsage:  true,
 		SilenceErrors: true,
 		RunE: func(cobraCmd *cobra.Command, args []string) error {
-			return cmd.Run()
+			return cmd.Run(cobraCmd.Context())
 		},
 	}
 
+	cobraCmd.Flags().StringVar(&cmd.Devcontainer, "devcontainer", "", "Path to a devcontainer.json to read the Dockerfile, context, target, build args and cache from.")
 	cobraCmd.Flags().StringVar(&cmd.Dockerfile, "dockerfile", "", "Dockerfile to build from.")
 	cobraCmd.Flags().StringVar(&cmd.Target, "target", "", "The docker target stage to build.")
-	cobraCmd.Flags().StringVar(&cmd.Context, "context", "", "Context to build from.")
+	cobraCmd.Flags().StringVar(&cmd.Context, "context", "", "Context to build from. Either a directory (optionally prefixed with dir://), a local tar archive (optionally prefixed with tar:// or file://) or - to read a tar stream from stdin.")
+	cobraCmd.Flags().StringVar(&cmd.Platform, "platform", "", "The platform to build for, e.g. linux/arm/v7. Defaults to the platform dockerless runs on.")
 	cobraCmd.Flags().StringArrayVar(&cmd.BuildArgs, "build-arg", []string{}, "Docker build args.")
-	cobraCmd.Flags().StringArrayVar(&cmd.IgnorePaths, "ignore-path", []string{}, "Extra paths to exclude from deletion.")
-	cobraCmd.Flags().BoolVar(&cmd.Insecure, "insecure", true, "If true will not check for certificates")
-	cobraCmd.Flags().StringVar(&cmd.RegistryCache, "registry-cache", "", "Registry to use as remote cache.")
+	cobraCmd.Flags().StringArrayVar(&cmd.BuildArgFiles, "build-arg-file", []string{}, "Dotenv file with build args of the form NAME=value. Can be specified multiple times.")
+	cobraCmd.Flags().StringArrayVar(&cmd.Features, "feature", []string{}, "Local devcontainer Feature folder to install on top of the target, optionally followed by options, e.g. ./features/go,version=1.22. Can be specified multiple times.")
+	cobraCmd.Flags().StringArrayVar(&cmd.Labels, "label", []string{}, "Label of the form key=value to add to the built image. Can be specified multiple times.")
+	cobraCmd.Flags().StringArrayVar(&cmd.IgnorePaths, "ignore-path", []string{}, "Extra path to exclude from deletion. Supports glob patterns such as /home/*/.cache, a trailing slash only excludes the contents of a directory. Can be specified multiple times.")
+	cobraCmd.Flags().StringArrayVar(&cmd.PersistPaths, "persist-path", []string{}, "Path to keep from the previous container, e.g. /home/*/.bash_history. It is restored on top of the new image. Can be specified multiple times.")
+	cmd.RegistryFlags.addFlags(cobraCmd.Flags())
+	cobraCmd.Flags().StringVar(&cmd.RegistryCache, "registry-cache", "", "Registry to use as remote cache. Use oci:/path for a shared cache dir.")
+	cobraCmd.Flags().StringVar(&cmd.SharedCacheDir, "cache-dir-shared", "", "OCI layout directory, e.g. oci:/mnt/cache, to share the layer cache with other containers.")
 	cobraCmd.Flags().BoolVar(&cmd.ExportCache, "export-cache", false, "If true kanoiko build push cache to registry.")
+	cobraCmd.Flags().DurationVar(&cmd.CacheTTL, "cache-ttl", 0, "How long cached layers are valid. Defaults to 168h.")
+	cobraCmd.Flags().StringVar(&cmd.CacheMaxSize, "cache-max-size", "", "If set, prunes the least recently used entries of the local cache to this size after the build, e.g. 10GB.")
+	cobraCmd.Flags().Var(&cmd.Compression, "compression", "Compression of the built layers, either gzip or zstd. Defaults to zstd.")
+	cobraCmd.Flags().IntVar(&cmd.CompressionLevel, "compression-level", 0, "Compression level of the built layers. Defaults to 3.")
+	cobraCmd.Flags().StringVar(&cmd.SnapshotMode, "snapshot-mode", "", "How to detect filesystem changes, either full, redo or time. Defaults to redo.")
+	cobraCmd.Flags().StringVar(&cmd.OCILayoutPath, "oci-layout-path", "", "If set, exports the built image as OCI image layout to this directory.")
+	cobraCmd.Flags().StringVar(&cmd.TarPath, "tar-path", "", "If set, exports the built image as docker tarball to this file.")
+	cobraCmd.Flags().StringArrayVar(&cmd.Destinations, "destination", []string{}, "Registry destinations to push the built image to. Can be specified multiple times.")
+	cobraCmd.Flags().StringVar(&cmd.DigestFile, "digest-file", "", "If set, writes the digest of the built image to this file.")
+	cobraCmd.Flags().StringVar(&cmd.ImageNameTagDigestFile, "image-name-tag-with-digest-file", "", "If set, writes the pushed image names with tag and digest to this file.")
+	cobraCmd.Flags().BoolVar(&cmd.IKnowWhatIAmDoing, "i-know-what-i-am-doing", false, "If true will delete the filesystem even if dockerless does not seem to run inside a container.")
+	cobraCmd.Flags().BoolVar(&cmd.ExplainCache, "explain-cache", false, "If true prints which commands hit the cache and which cache key components changed since the previous build.")
+	cobraCmd.Flags().BoolVar(&cmd.SkipDiskSpaceCheck, "skip-disk-space-check", false, "If true will not check that the image fits on the disk before deleting the filesystem.")
+	cobraCmd.Flags().BoolVar(&cmd.DryRun, "dry-run", false, "If true will only print the build plan without changing the filesystem.")
+	cobraCmd.Flags().BoolVar(&cmd.Force, "force", false, "If true will rebuild the image even if the build inputs have not changed.")
 	return cobraCmd
 }
 
-func (cmd *BuildCmd) Run() error {
-	// check if we already have built the image
-	_, err := os.Stat(ImageConfigOutput)
-	if err == nil {
-		fmt.Println("skip building, because image is already built")
-		return nil
+func (cmd *BuildCmd) Run(ctx context.Context) error {
+	// abort all registry and remote file downloads when we get interrupted
+	cancelDownloads(ctx)
+
+	// a dry run does not change anything, so it should not change the status either
+	if cmd.DryRun {
+		return cmd.run(ctx)
+	}
+
+	// make sure only a single build changes the filesystem at a time
+	lock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// persist the build status, so start --wait knows when the build has failed
+	status, err := newBuildStatus()
+	if err != nil {
+		return err
 	}
 
-	// fill parameters through env
+	// remember the stage kaniko is building, so we can report where the build failed
+	tracker := &stageTracker{}
+	logrus.AddHook(tracker)
+
+	buildErr := cmd.run(ctx)
+	if buildErr != nil && ctx.Err() != nil && !errors.Is(buildErr, ErrBuildInterrupted) {
+		buildErr = fmt.Errorf("%w: %w", ErrBuildInterrupted, buildErr)
+	}
+	err = status.finish(buildErr, tracker.Stage())
+	if buildErr != nil {
+		return buildErr
+	}
+
+	return err
+}
+
+func (cmd *BuildCmd) run(ctx context.Context) error {
+	// fill parameters through env, flags take precedence
 	if cmd.Dockerfile == "" {
 		cmd.Dockerfile = os.Getenv("DOCKERLESS_DOCKERFILE")
-		if cmd.Dockerfile == "" {
-			return fmt.Errorf("--dockerfile is missing")
-		}
 	}
 	if cmd.Context == "" {
 		cmd.Context = os.Getenv("DOCKERLESS_CONTEXT")
-		if cmd.Context == "" {
-			return fmt.Errorf("--context is missing")
-		}
 	}
 	if cmd.Target == "" {
 		cmd.Target = os.Getenv("DOCKERLESS_TARGET")
 	}
+	if cmd.SharedCacheDir == "" {
+		cmd.SharedCacheDir = os.Getenv("DOCKERLESS_CACHE_DIR_SHARED")
+	}
+
+	// fill the remaining parameters through the devcontainer.json
+	if cmd.Devcontainer == "" {
+		cmd.Devcontainer = os.Getenv("DOCKERLESS_DEVCONTAINER")
+	}
+	if cmd.Devcontainer != "" {
+		devContainerConfig, err := readDevContainerConfig(cmd.Devcontainer)
+		if err != nil {
+			return err
+		}
+
+		err = cmd.applyDevContainerConfig(devContainerConfig)
+		if err != nil {
+			return err
+		}
+	}
+	if cmd.Dockerfile == "" {
+		return fmt.Errorf("--dockerfile is missing")
+	}
+	if cmd.Context == "" {
+		return fmt.Errorf("--context is missing")
+	}
+
+	// collect the build args from the environment, files and flags
+	buildArgs, err := resolveBuildArgs(cmd.devContainerBuildArgs, cmd.BuildArgs, cmd.BuildArgFiles)
+	if err != nil {
+		return err
+	}
+	cmd.BuildArgs = buildArgs
+
+	// parse and validate the build options
+	err = cmd.parseBuildOptions()
+	if err != nil {
+		return err
+	}
+
+	// resolve the build context before we delete anything, as archives might live on the filesystem
+	contextDir, err := resolveContext(cmd.Context)
+	if err != nil {
+		return fmt.Errorf("resolve context: %w", err)
+	}
+
+	dockerfile, err := resolveDockerfile(cmd.Dockerfile, contextDir)
+	if err != nil {
+		return fmt.Errorf("resolve dockerfile: %w", err)
+	}
+
+	opts := cmd.kanikoOptions(contextDir, dockerfile)
+
+	// every base image is only retrieved once. If we cannot reach a registry, we fall back to the
+	// digests of the previous build, so an image that is up to date can be started offline.
+	previous, _ := readFingerprint()
+	images := newBaseImageResolver(opts, previous)
+
+	// install the devcontainer Features in extra stages on top of the target
+	features, err := cmd.resolveFeatures()
+	if err != nil {
+		return err
+	}
+	if len(features) > 0 {
+		err = cmd.applyFeatures(opts, images, features)
+		if err != nil {
+			return err
+		}
+
+		// the staged Features are neither part of the image nor needed by the next build
+		defer os.RemoveAll(filepath.Dir(opts.DockerfilePath))
+	}
 
-	// parse extra build args
-	buildArgs := os.Getenv("DOCKERLESS_BUILD_ARGS")
-	if buildArgs != "" {
-		extraBuildArgs := []string{}
-		_ = json.Unmarshal([]byte(buildArgs), &extraBuildArgs)
-		cmd.BuildArgs = append(cmd.BuildArgs, extraBuildArgs...)
+	// plan the build first, so an invalid Dockerfile or target fails before we delete anything
+	plan, err := planBuild(opts, images)
+	if err != nil {
+		return err
+	} else if cmd.DryRun {
+		return printPlan(plan)
+	}
+	if len(plan.UnusedBuildArgs) > 0 {
+		fmt.Printf("warning: build args %s are not declared in the Dockerfile\n", strings.Join(plan.UnusedBuildArgs, ", "))
+	}
+
+	// check if we already have built the image from the same inputs
+	fingerprint, err := calculateFingerprint(ctx, opts, images, cmd.outputs())
+	if err != nil {
+		return fmt.Errorf("calculate build fingerprint: %w", err)
+	}
+	if !cmd.Force && isImageUpToDate(fingerprint) && cmd.outputsExist() {
+		fmt.Println("skip building, because image is already built")
+		cmd.pruneCache(opts, fingerprint)
+		return nil
+	}
+
+	// pass our proxy settings to the declared proxy args. We add them after calculating the
+	// fingerprint and kaniko leaves them out of its cache keys, so a changed proxy neither causes
+	// a rebuild nor invalidates cached layers.
+	opts.BuildArgs = append(opts.BuildArgs, proxyBuildArgs(opts.BuildArgs, plan.DeclaredBuildArgs)...)
+
+	// fail early if we are not allowed to push the image
+	err = cmd.checkPushPermissions(opts)
+	if err != nil {
+		return err
+	}
+
+	// remove the previous image config, so nobody starts the outdated image
+	err = os.Remove(ImageConfigOutput)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove previous image config: %w", err)
+	}
+
+	// hash the Dockerfile before we delete anything, as remote Dockerfiles might not be reachable afterwards
+	dockerfileDigest, err := digestDockerfile(ctx, dockerfile)
+	if err != nil {
+		return err
 	}
 
 	// start actual build
-	image, err := cmd.build()
+	buildTime := time.Now()
+	image, err := cmd.build(ctx, opts, images)
+	if err != nil {
+		return err
+	}
+
+	// make the image traceable to the workspace that built it
+	image, err = cmd.addProvenanceLabels(image, dockerfileDigest, contextDir, buildTime)
 	if err != nil {
 		return err
 	}
@@ -103,17 +299,66 @@ func (cmd *BuildCmd) Run() error {
 		return fmt.Errorf("marshal image config: %w", err)
 	}
 
-	err = os.WriteFile(ImageConfigOutput, out, 0666)
+	err = writeStateFile(ImageConfigOutput, out)
 	if err != nil {
 		return fmt.Errorf("write image config: %w", err)
 	}
 
+	// export and push the complete image if requested. We only write the fingerprint
+	// afterwards, so a failed export or push is retried with the next build.
+	err = cmd.exportImage(image)
+	if err != nil {
+		return err
+	}
+
+	err = cmd.pushImage(image, opts)
+	if err != nil {
+		return err
+	}
+
+	err = writeFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	cmd.pruneCache(opts, fingerprint)
 	return nil
 }
 
-func (cmd *BuildCmd) build() (v1.Image, error) {
+// pruneCache removes expired entries from the local cache and enforces --cache-max-size. The
+// base images of this build are marked as used first, so they are the last ones to be removed.
+func (cmd *BuildCmd) pruneCache(opts *config.KanikoOptions, fingerprint *BuildFingerprint) {
+	if opts.CacheDir == "" {
+		return
+	}
+
+	digests := []string{}
+	for _, digest := range fingerprint.BaseImages {
+		digests = append(digests, digest)
+	}
+	err := markCacheEntriesUsed(opts.CacheDir, digests)
+	if err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+
+	removed, err := pruneCache(opts.CacheDir, PruneOptions{
+		CacheTTL: opts.CacheTTL,
+		MaxSize:  cmd.cacheMaxSize,
+	})
+	if err != nil {
+		fmt.Printf("warning: prune cache: %v\n", err)
+	} else if len(removed) > 0 {
+		printPrunedEntries(removed)
+	}
+}
+
+func (cmd *BuildCmd) build(ctx context.Context, opts *config.KanikoOptions, images *baseImageResolver) (v1.Image, error) {
 	// add ignore paths
-	buildIgnorePaths(cmd.IgnorePaths)
+	ignorePaths := cmd.ignorePaths
+	if cmd.sharedCacheDir != "" {
+		ignorePaths = append(ignorePaths, util.IgnoreListEntry{Path: cmd.sharedCacheDir})
+	}
+	buildIgnorePaths(ignorePaths)
 
 	// make sure we detect the correct ignore list
 	err := util.InitIgnoreList(true)
@@ -121,10 +366,38 @@ func (cmd *BuildCmd) build() (v1.Image, error) {
 		return nil, fmt.Errorf("init ignore list: %w", err)
 	}
 
-	// make sure to delete previous contents
-	err = util.DeleteFilesystem()
+	// make sure we do not destroy the host
+	if !cmd.IKnowWhatIAmDoing {
+		err = ensureContainer()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// do not delete anything if we were interrupted in the meantime
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBuildInterrupted, ctx.Err())
+	}
+
+	// make sure the new image fits on the disk, before we delete the current one
+	var estimate *diskSpaceEstimate
+	if !cmd.SkipDiskSpaceCheck {
+		estimate, err = cmd.checkDiskSpace(opts, images)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// save the paths to persist, before we delete them
+	err = persistPaths(cmd.PersistPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	// reset the previous contents, or delete them if we cannot reuse the base image
+	recordLayers, err := prepareRootFS(opts, images)
 	if err != nil {
-		return nil, fmt.Errorf("delete filesystem: %w", err)
+		return nil, err
 	}
 
 	// change dir before building
@@ -133,20 +406,117 @@ func (cmd *BuildCmd) build() (v1.Image, error) {
 		return nil, fmt.Errorf("change dir: %w", err)
 	}
 
+	// link the shared cache, so kaniko can reuse the layers other containers have built
+	var shared *sharedCache
+	if cmd.sharedCacheDir != "" {
+		shared, err = openSharedCache(cmd.sharedCacheDir, cmd.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// let's build! kaniko only logs its cache keys at debug level, so we only collect them to explain the cache
+	var explainer *cacheExplainer
+	if cmd.ExplainCache {
+		explainer = startCacheExplainer()
+	}
+	image, err := doBuild(ctx, opts)
+	if explainer != nil {
+		keysErr := writeCacheKeys(explainer.stop())
+		if keysErr != nil {
+			fmt.Printf("warning: %v\n", keysErr)
+		}
+	} else {
+		removeCacheKeys()
+	}
+
+	// layers of successful commands are valid even if the build failed, so we always publish them
+	if shared != nil {
+		publishErr := shared.publish()
+		if publishErr != nil {
+			fmt.Printf("warning: %v\n", publishErr)
+		}
+	}
+	if err != nil {
+		// add a passwd as other we won't be able to exec into this container
+		if addPwdErr := addPasswd(); addPwdErr != nil {
+			return nil, fmt.Errorf("build and add passwd error occurred: %w --- %w", err, addPwdErr)
+		} else if errors.Is(err, ErrBuildInterrupted) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("build error: %w", err)
+	}
+
+	// restore the persisted paths on top of the new image
+	conflicts, err := restorePersistedPaths()
+	if err != nil {
+		return nil, err
+	}
+	for _, conflict := range conflicts {
+		fmt.Printf("warning: persisted %s replaced the version of the image\n", conflict)
+	}
+
+	// remember the layers on /, so the next build only needs to extract the ones that changed
+	if recordLayers {
+		err = recordRootFS(image)
+		if err != nil {
+			fmt.Printf("warning: %v\n", err)
+		}
+	}
+
+	// remember the space the build needed besides its base images for the next disk space check
+	if estimate != nil {
+		err = recordDiskUsage(estimate)
+		if err != nil {
+			fmt.Printf("warning: %v\n", err)
+		}
+	}
+
+	return image, nil
+}
+
+// doBuild runs the kaniko build until it is done or ctx is cancelled. kaniko itself cannot be
+// cancelled, so we kill the running RUN commands and give the build a moment to stop.
+func doBuild(ctx context.Context, opts *config.KanikoOptions) (v1.Image, error) {
+	type buildResult struct {
+		image v1.Image
+		err   error
+	}
+
+	done := make(chan buildResult, 1)
+	go func() {
+		image, err := executor.DoBuild(opts)
+		done <- buildResult{image: image, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.image, result.err
+	case <-ctx.Done():
+		fmt.Println("build was interrupted, stopping running commands")
+		killChildProcessGroups()
+		select {
+		case <-done:
+		case <-time.After(interruptGracePeriod):
+		}
+
+		return nil, fmt.Errorf("%w: %w", ErrBuildInterrupted, ctx.Err())
+	}
+}
+
+func (cmd *BuildCmd) kanikoOptions(contextDir, dockerfile string) *config.KanikoOptions {
 	opts := &config.KanikoOptions{
-		Destinations:   []string{"local"},
-		Unpack:         true,
-		BuildArgs:      cmd.BuildArgs,
-		DockerfilePath: cmd.Dockerfile,
-		RegistryOptions: config.RegistryOptions{
-			Insecure:      cmd.Insecure,
-			InsecurePull:  cmd.Insecure,
-			SkipTLSVerify: cmd.Insecure,
-		},
-		SrcContext:          cmd.Context,
+		Destinations:        []string{"local"},
+		Unpack:              true,
+		BuildArgs:           cmd.BuildArgs,
+		Labels:              cmd.Labels,
+		DockerfilePath:      dockerfile,
+		RegistryOptions:     cmd.registryOptions(),
+		SrcContext:          contextDir,
 		Target:              cmd.Target,
-		CustomPlatform:      platforms.Format(platforms.Normalize(platforms.DefaultSpec())),
-		SnapshotMode:        "redo",
+		CustomPlatform:      cmd.Platform,
+		SnapshotMode:        cmd.SnapshotMode,
 		RunV2:               true,
 		NoPush:              true,
 		KanikoDir:           "/.dockerless",
@@ -156,34 +526,51 @@ func (cmd *BuildCmd) build() (v1.Image, error) {
 		CompressedCaching:   true,
 		SkipUnusedStages:    true,
 		ImageFSExtractRetry: 3,
-		NoPushCache:         !cmd.ExportCache,
-		Compression:         config.ZStd,
-		CompressionLevel:    3,
+		NoPushCache:         !cmd.exportCache(),
+		Compression:         cmd.Compression,
+		CompressionLevel:    cmd.CompressionLevel,
 		CacheOptions: config.CacheOptions{
-			CacheTTL: time.Hour * 24 * 7,
+			CacheTTL: cmd.CacheTTL,
 		},
 	}
-	if cmd.RegistryCache != "" {
+	if cmd.sharedCacheDir != "" {
+		opts.CacheRepo = sharedCacheRepo()
+		opts.CacheOptions.CacheDir = defaultCacheDir
+	} else if cmd.RegistryCache != "" {
 		opts.CacheRepo = cmd.RegistryCache
 	} else {
 		opts.CacheOptions.CacheDir = defaultCacheDir
 	}
-	if !cmd.ExportCache {
+	if !cmd.exportCache() {
 		opts.SingleSnapshot = true
 	}
 
-	// let's build!
-	image, err := executor.DoBuild(opts)
+	return opts
+}
+
+// exportCache returns true if the built layers should be written to the cache repo. A shared
+// cache dir is only useful if builds add their layers, so it always exports them.
+func (cmd *BuildCmd) exportCache() bool {
+	return cmd.ExportCache || cmd.sharedCacheDir != ""
+}
+
+// isImageUpToDate returns true if the image was already built from the inputs described by fingerprint
+func isImageUpToDate(fingerprint *BuildFingerprint) bool {
+	_, err := os.Stat(ImageConfigOutput)
 	if err != nil {
-		// add a passwd as other we won't be able to exec into this container
-		if addPwdErr := addPasswd(); addPwdErr != nil {
-			return nil, fmt.Errorf("build and add passwd error occurred: %w --- %w", err, addPwdErr)
-		}
+		return false
+	}
 
-		return nil, fmt.Errorf("build error: %w", err)
+	previous, err := readFingerprint()
+	if err != nil {
+		fmt.Printf("rebuilding image, because previous fingerprint is not available: %v\n", err)
+		return false
+	} else if previous.Hash != fingerprint.Hash {
+		fmt.Printf("rebuilding image, because inputs have changed: %s\n", strings.Join(fingerprint.changedInputs(previous), ", "))
+		return false
 	}
 
-	return image, nil
+	return true
 }
 
 func addPasswd() error {
@@ -195,20 +582,23 @@ func addPasswd() error {
 	return nil
 }
 
-func buildIgnorePaths(extraPaths []string) {
+func buildIgnorePaths(extraPaths []util.IgnoreListEntry) {
 	// we need to add a couple of extra ignore paths for kaniko
-	ignorePaths := append([]string{
+	for _, ignorePath := range []string{
 		"/.dockerless",
 		"/workspaces",
 		"/etc/envfile.json",
 		"/etc/resolv.conf",
 		"/var/run",
 		"/product_uuid",
-	}, extraPaths...)
-	for _, ignorePath := range ignorePaths {
+	} {
 		util.AddToDefaultIgnoreList(util.IgnoreListEntry{
 			Path:            ignorePath,
 			PrefixMatchOnly: false,
 		})
 	}
+
+	for _, ignorePath := range append(extraPaths, expandIgnorePaths(extraPaths)...) {
+		util.AddToDefaultIgnoreList(ignorePath)
+	}
 }
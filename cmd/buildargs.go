@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// buildArgEnvPrefix passes env variables such as DOCKERLESS_BUILD_ARG_VERSION=1 as build arg VERSION=1
+const buildArgEnvPrefix = "DOCKERLESS_BUILD_ARG_"
+
+// resolveBuildArgs collects the build args from the defaults (e.g. a devcontainer.json), DOCKERLESS_BUILD_ARG_<NAME>,
+// DOCKERLESS_BUILD_ARGS, the build arg files and the flags. Later sources take precedence, so flags override everything else.
+func resolveBuildArgs(defaultArgs, flagArgs, files []string) ([]string, error) {
+	buildArgs := append([]string{}, defaultArgs...)
+	buildArgs = append(buildArgs, prefixedBuildArgsFromEnv()...)
+
+	envArgs, err := jsonListFromEnv("DOCKERLESS_BUILD_ARGS")
+	if err != nil {
+		return nil, err
+	}
+	buildArgs = append(buildArgs, envArgs...)
+
+	for _, file := range files {
+		fileArgs, err := readBuildArgFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		buildArgs = append(buildArgs, fileArgs...)
+	}
+
+	return dedupBuildArgs(append(buildArgs, flagArgs...)), nil
+}
+
+// prefixedBuildArgsFromEnv returns all DOCKERLESS_BUILD_ARG_<NAME> variables as build args, sorted by name
+func prefixedBuildArgsFromEnv() []string {
+	buildArgs := []string{}
+	for _, envVar := range os.Environ() {
+		name, value, _ := strings.Cut(envVar, "=")
+		argName, ok := strings.CutPrefix(name, buildArgEnvPrefix)
+		if ok && argName != "" {
+			buildArgs = append(buildArgs, argName+"="+value)
+		}
+	}
+	sort.Strings(buildArgs)
+
+	return buildArgs
+}
+
+// readBuildArgFile reads a dotenv file. Empty lines, comments and an export prefix are ignored, values
+// can be single quoted (taken literally) or double quoted (with \n, \" and \\ escapes).
+func readBuildArgFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open build arg file: %w", err)
+	}
+	defer file.Close()
+
+	buildArgs := []string{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		name, value, hasValue := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid build arg in %s line %d: expected NAME=value", path, lineNumber)
+		} else if !hasValue {
+			// like --build-arg NAME, the value is taken from the Dockerfile
+			buildArgs = append(buildArgs, name)
+			continue
+		}
+
+		value, err = parseDotenvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of build arg %s in %s line %d: %w", name, path, lineNumber, err)
+		}
+
+		buildArgs = append(buildArgs, name+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read build arg file: %w", err)
+	}
+
+	return buildArgs, nil
+}
+
+// parseDotenvValue parses the value of a dotenv line. Like other dotenv parsers, double quoted values
+// only unescape \n, \" and \\ and keep all other backslashes, e.g. in Windows paths or \$.
+func parseDotenvValue(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) && !strings.HasPrefix(value, "'") {
+		// strip trailing comments of unquoted values
+		if index := strings.Index(value, " #"); index >= 0 {
+			value = strings.TrimSpace(value[:index])
+		}
+
+		return value, nil
+	}
+
+	quote := value[0]
+	parsed := strings.Builder{}
+	for i := 1; i < len(value); i++ {
+		switch {
+		case value[i] == quote:
+			// only a comment may follow the closing quote
+			rest := strings.TrimSpace(value[i+1:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %s after closing quote", rest)
+			}
+
+			return parsed.String(), nil
+		case quote == '"' && value[i] == '\\' && i+1 < len(value):
+			switch value[i+1] {
+			case 'n':
+				parsed.WriteByte('\n')
+				i++
+			case '"', '\\':
+				parsed.WriteByte(value[i+1])
+				i++
+			default:
+				parsed.WriteByte(value[i])
+			}
+		default:
+			parsed.WriteByte(value[i])
+		}
+	}
+
+	return "", fmt.Errorf("missing closing quote")
+}
+
+// dedupBuildArgs keeps the last value of every build arg at the position it was first defined
+func dedupBuildArgs(buildArgs []string) []string {
+	positions := map[string]int{}
+	deduped := []string{}
+	for _, buildArg := range buildArgs {
+		name, _, _ := strings.Cut(buildArg, "=")
+		if position, ok := positions[name]; ok {
+			deduped[position] = buildArg
+			continue
+		}
+
+		positions[name] = len(deduped)
+		deduped = append(deduped, buildArg)
+	}
+
+	return deduped
+}
+
+// proxyBuildArgs returns the proxy settings of our environment for all predefined proxy args the
+// Dockerfile declares and that were not set explicitly.
+func proxyBuildArgs(buildArgs, declaredArgs []string) []string {
+	set := map[string]bool{}
+	for _, buildArg := range buildArgs {
+		name, _, _ := strings.Cut(buildArg, "=")
+		set[name] = true
+	}
+
+	proxyArgs := []string{}
+	for _, name := range declaredArgs {
+		if !builtinBuildArgs[name] || set[name] {
+			continue
+		}
+
+		if value, ok := os.LookupEnv(name); ok {
+			proxyArgs = append(proxyArgs, name+"="+value)
+		}
+	}
+
+	return proxyArgs
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+)
+
+func TestParseDotenvValue(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: `plain`, want: `plain`},
+		{value: `plain # comment`, want: `plain`},
+		{value: `with#hash`, want: `with#hash`},
+		{value: ``, want: ``},
+		{value: `'single $HOME \n'`, want: `single $HOME \n`},
+		{value: `'single' # comment`, want: `single`},
+		{value: `"double"`, want: `double`},
+		{value: `"line\nbreak"`, want: "line\nbreak"},
+		{value: `"say \"hi\""`, want: `say "hi"`},
+		{value: `"back\\slash"`, want: `back\slash`},
+		{value: `"C:\Users\dev\go"`, want: `C:\Users\dev\go`},
+		{value: `"\$HOME \t"`, want: `\$HOME \t`},
+		{value: `"value" # comment`, want: `value`},
+		{value: `"value"   `, want: `value`},
+		{value: `"# not a comment"`, want: `# not a comment`},
+		{value: `"missing`, wantErr: true},
+		{value: `'missing`, wantErr: true},
+		{value: `"escaped quote\"`, wantErr: true},
+		{value: `"value" trailing`, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseDotenvValue(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %q", test.value, got)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.value, test.want, got)
+		}
+	}
+}
+
+func TestReadBuildArgFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "build.env")
+	writeFile(t, path, `# comment
+
+export VERSION=1.22
+GOPATH="C:\go" # windows
+NAME = 'dockerless'
+FROM_DOCKERFILE
+`)
+
+	got, err := readBuildArgFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"VERSION=1.22", `GOPATH=C:\go`, "NAME=dockerless", "FROM_DOCKERFILE"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	for _, invalid := range []string{"MY ARG=1", "=1", `QUOTED="unterminated`} {
+		path := filepath.Join(t.TempDir(), "build.env")
+		writeFile(t, path, invalid)
+		_, err := readBuildArgFile(path)
+		if err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestResolveBuildArgs(t *testing.T) {
+	t.Setenv("DOCKERLESS_BUILD_ARG_PREFIXED", "env")
+	t.Setenv("DOCKERLESS_BUILD_ARG_DEFAULT", "env")
+	t.Setenv("DOCKERLESS_BUILD_ARGS", `["LIST=env", "FILE=env"]`)
+	file := filepath.Join(t.TempDir(), "build.env")
+	writeFile(t, file, "FILE=file\nFLAG=file\n")
+
+	got, err := resolveBuildArgs([]string{"DEFAULT=devcontainer", "ONLY_DEFAULT=devcontainer"}, []string{"FLAG=flag"}, []string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"DEFAULT=env", "ONLY_DEFAULT=devcontainer", "PREFIXED=env", "LIST=env", "FILE=file", "FLAG=flag"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	t.Setenv("DOCKERLESS_BUILD_ARGS", "LIST=env")
+	_, err = resolveBuildArgs(nil, nil, nil)
+	if err == nil {
+		t.Fatal("expected invalid DOCKERLESS_BUILD_ARGS to fail")
+	}
+}
+
+func TestProxyBuildArgs(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://proxy:3128")
+	t.Setenv("HTTPS_PROXY", "http://proxy:3128")
+	t.Setenv("NO_PROXY", "localhost")
+
+	got := proxyBuildArgs([]string{"HTTPS_PROXY=http://other:3128"}, []string{"HTTP_PROXY", "HTTPS_PROXY", "VERSION"})
+	want := []string{"HTTP_PROXY=http://proxy:3128"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestProxyBuildArgsKeepCacheKeys(t *testing.T) {
+	setupDiskSpaceDirs(t)
+	contextDir := t.TempDir()
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	// the command does not exist, so kaniko calculates the cache key but cannot run anything
+	writeFile(t, dockerfile, "FROM scratch\nARG HTTP_PROXY\nARG NAME\nRUN [\"/dockerless-missing-command\"]\n")
+
+	cacheKey := func(buildArgs ...string) string {
+		t.Helper()
+
+		opts := &config.KanikoOptions{
+			DockerfilePath: dockerfile,
+			SrcContext:     contextDir,
+			BuildArgs:      buildArgs,
+			Cache:          true,
+			CacheRepo:      ociCachePrefix + t.TempDir(),
+			NoPush:         true,
+			SnapshotMode:   defaultSnapshotMode,
+		}
+		explainer := startCacheExplainer()
+		_, err := doBuild(context.Background(), opts)
+		record := explainer.stop()
+		if err == nil {
+			t.Fatal("expected the missing command to fail the build")
+		}
+
+		for _, command := range record.Stages[0].Commands {
+			if strings.HasPrefix(command.Command, "RUN ") {
+				return command.CacheKey
+			}
+		}
+		t.Fatalf("expected cache key of the RUN command, got %+v", record.Stages[0].Commands)
+		return ""
+	}
+
+	withProxy := cacheKey("HTTP_PROXY=http://proxy:3128", "NAME=app")
+	if withProxy == "" {
+		t.Fatal("expected cache key")
+	} else if key := cacheKey("HTTP_PROXY=http://other:8080", "NAME=app"); key != withProxy {
+		t.Fatalf("expected a changed proxy to keep cache key %s, got %s", withProxy, key)
+	} else if key := cacheKey("NAME=app"); key != withProxy {
+		t.Fatalf("expected a missing proxy to keep cache key %s, got %s", withProxy, key)
+	} else if key := cacheKey("HTTP_PROXY=http://proxy:3128", "NAME=other"); key == withProxy {
+		t.Fatal("expected other build args to change the cache key")
+	}
+}
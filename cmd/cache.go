@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+// NewCacheCmd returns a new cache command
+func NewCacheCmd() *cobra.Command {
+	cobraCmd := &cobra.Command{
+		Use:           "cache",
+		Short:         "Manage the local build cache",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cobraCmd.AddCommand(NewCacheListCmd())
+	cobraCmd.AddCommand(NewCacheInspectCmd())
+	cobraCmd.AddCommand(NewCachePruneCmd())
+	cobraCmd.AddCommand(NewCacheExportCmd())
+	cobraCmd.AddCommand(NewCacheImportCmd())
+	return cobraCmd
+}
+
+type CacheListCmd struct {
+	CacheDir string
+}
+
+// NewCacheListCmd returns a new cache ls command
+func NewCacheListCmd() *cobra.Command {
+	cmd := &CacheListCmd{}
+	cobraCmd := &cobra.Command{
+		Use:           "ls",
+		Short:         "Lists the entries of the local build cache",
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			return cmd.Run()
+		},
+	}
+
+	cobraCmd.Flags().StringVar(&cmd.CacheDir, "cache-dir", defaultCacheDir, "The local cache directory.")
+	return cobraCmd
+}
+
+func (cmd *CacheListCmd) Run() error {
+	entries, err := listCacheEntries(cmd.CacheDir)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "KEY\tKIND\tDIGEST\tSIZE\tAGE\tLAST USED\tCREATED BY")
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Key,
+			entry.Kind,
+			shortDigest(entry.Digest),
+			units.BytesSize(float64(entry.Size)),
+			units.HumanDuration(time.Since(entry.Created)),
+			units.HumanDuration(time.Since(entry.LastUsed))+" ago",
+			entry.CreatedBy,
+		)
+	}
+
+	return writer.Flush()
+}
+
+type CacheInspectCmd struct {
+	CacheDir string
+}
+
+// NewCacheInspectCmd returns a new cache inspect command
+func NewCacheInspectCmd() *cobra.Command {
+	cmd := &CacheInspectCmd{}
+	cobraCmd := &cobra.Command{
+		Use:           "inspect KEY",
+		Short:         "Shows a single entry of the local build cache",
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			return cmd.Run(args[0])
+		},
+	}
+
+	cobraCmd.Flags().StringVar(&cmd.CacheDir, "cache-dir", defaultCacheDir, "The local cache directory.")
+	return cobraCmd
+}
+
+func (cmd *CacheInspectCmd) Run(key string) error {
+	entry, err := readCacheEntry(cmd.CacheDir, key)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal cache entry: %w", err)
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+type CachePruneCmd struct {
+	CacheDir  string
+	MaxSize   string
+	CacheTTL  time.Duration
+	OlderThan time.Duration
+}
+
+// NewCachePruneCmd returns a new cache prune command
+func NewCachePruneCmd() *cobra.Command {
+	cmd := &CachePruneCmd{}
+	cobraCmd := &cobra.Command{
+		Use:           "prune",
+		Short:         "Removes expired and least recently used entries from the local build cache",
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			return cmd.Run()
+		},
+	}
+
+	cobraCmd.Flags().StringVar(&cmd.CacheDir, "cache-dir", defaultCacheDir, "The local cache directory.")
+	cobraCmd.Flags().DurationVar(&cmd.CacheTTL, "cache-ttl", 0, "Entries older than this are expired and always removed. Defaults to 168h.")
+	cobraCmd.Flags().DurationVar(&cmd.OlderThan, "older-than", 0, "If set, removes entries that were not used within this duration.")
+	cobraCmd.Flags().StringVar(&cmd.MaxSize, "max-size", "", "If set, removes the least recently used entries until the cache is smaller than this size, e.g. 10GB.")
+	return cobraCmd
+}
+
+func (cmd *CachePruneCmd) Run() error {
+	cacheTTL, err := resolveCacheTTL(cmd.CacheTTL)
+	if err != nil {
+		return err
+	}
+
+	maxSize, err := parseCacheMaxSize(cmd.MaxSize)
+	if err != nil {
+		return err
+	}
+
+	// make sure we do not remove entries a running build is using
+	lock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// the cache dir might be shared with builds in other containers
+	cacheLock, err := lockCacheDir(cmd.CacheDir, true)
+	if err != nil {
+		return err
+	}
+	defer cacheLock.Unlock()
+
+	removed, err := pruneCache(cmd.CacheDir, PruneOptions{
+		CacheTTL:  cacheTTL,
+		OlderThan: cmd.OlderThan,
+		MaxSize:   maxSize,
+	})
+	printPrunedEntries(removed)
+	return err
+}
+
+// parseCacheMaxSize parses a human readable size such as 10GB, an empty size means no limit
+func parseCacheMaxSize(maxSize string) (int64, error) {
+	if maxSize == "" {
+		return 0, nil
+	}
+
+	size, err := units.RAMInBytes(maxSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache max size %s: %w", maxSize, err)
+	} else if size < 0 {
+		return 0, fmt.Errorf("invalid cache max size %s: must not be negative", maxSize)
+	}
+
+	return size, nil
+}
+
+func printPrunedEntries(removed []*CacheEntry) {
+	var size int64
+	for _, entry := range removed {
+		fmt.Printf("removed cache entry %s (%s)\n", entry.Key, units.BytesSize(float64(entry.Size)))
+		size += entry.Size
+	}
+
+	fmt.Printf("pruned %d cache entries, freed %s\n", len(removed), units.BytesSize(float64(size)))
+}
+
+// shortDigest shortens sha256:abc... to the first 12 characters of the hash
+func shortDigest(digest string) string {
+	if len(digest) > len("sha256:")+12 {
+		return digest[len("sha256:") : len("sha256:")+12]
+	}
+
+	return digest
+}
@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// CacheEntryKind is the kind of data a cache entry holds
+type CacheEntryKind string
+
+const (
+	// CacheEntryBaseImage is a base image tarball, written by dockerless warm
+	CacheEntryBaseImage CacheEntryKind = "base-image"
+	// CacheEntryLayer is a cached layer stored as OCI image layout
+	CacheEntryLayer CacheEntryKind = "layer"
+)
+
+var ErrCacheEntryNotFound = errors.New("cache entry not found")
+
+// lastUsedDir holds an empty file for every cache entry, whose modification time records when a build
+// used the entry last. The entries keep their own modification time, as kaniko uses it to expire them.
+const lastUsedDir = ".used"
+
+// CacheEntry is a single entry of the local cache dir
+type CacheEntry struct {
+	Key       string         `json:"key"`
+	Kind      CacheEntryKind `json:"kind"`
+	Digest    string         `json:"digest,omitempty"`
+	CreatedBy string         `json:"createdBy,omitempty"`
+	Layers    []string       `json:"layers,omitempty"`
+	Size      int64          `json:"size"`
+	Created   time.Time      `json:"created"`
+	LastUsed  time.Time      `json:"lastUsed"`
+
+	paths    []string
+	usedPath string
+}
+
+// expired returns true if kaniko would not use this entry anymore
+func (e *CacheEntry) expired(cacheTTL time.Duration) bool {
+	return e.Created.Add(cacheTTL).Before(time.Now())
+}
+
+// listCacheEntries returns all entries in cacheDir, sorted by key
+func listCacheEntries(cacheDir string) ([]*CacheEntry, error) {
+	files, err := os.ReadDir(cacheDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("read cache dir: %w", err)
+	}
+
+	entries := []*CacheEntry{}
+	for _, file := range files {
+		// skip temporary files and manifests, which belong to the base image next to them
+		if strings.HasPrefix(file.Name(), ".") || (!file.IsDir() && strings.HasSuffix(file.Name(), ".json")) {
+			continue
+		}
+
+		entry, err := readCacheEntry(cacheDir, file.Name())
+		if err != nil {
+			fmt.Printf("warning: skip cache entry %s: %v\n", file.Name(), err)
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries, nil
+}
+
+// readCacheEntry reads the entry key in cacheDir
+func readCacheEntry(cacheDir, key string) (*CacheEntry, error) {
+	if key == "" || strings.ContainsRune(key, filepath.Separator) {
+		return nil, fmt.Errorf("%w: %s", ErrCacheEntryNotFound, key)
+	}
+
+	path := filepath.Join(cacheDir, key)
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrCacheEntryNotFound, key)
+		}
+
+		return nil, err
+	}
+
+	entry := &CacheEntry{
+		Key:      key,
+		Created:  info.ModTime(),
+		LastUsed: info.ModTime(),
+		usedPath: filepath.Join(cacheDir, lastUsedDir, key),
+	}
+	if usedInfo, err := os.Stat(entry.usedPath); err == nil && usedInfo.ModTime().After(entry.LastUsed) {
+		entry.LastUsed = usedInfo.ModTime()
+	}
+	if info.IsDir() {
+		err = entry.readLayout(path)
+	} else {
+		err = entry.readBaseImage(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entryPath := range entry.paths {
+		size, err := diskUsage(entryPath)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Size += size
+	}
+
+	return entry, nil
+}
+
+// readBaseImage reads a base image tarball written by the cache warmer. The tarball is named after the image digest.
+func (e *CacheEntry) readBaseImage(path string) error {
+	e.Kind = CacheEntryBaseImage
+	e.Digest = e.Key
+	e.paths = []string{path}
+	if fileExists(path + ".json") {
+		e.paths = append(e.paths, path+".json")
+	}
+
+	manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) {
+		return os.Open(path)
+	})
+	if err != nil {
+		return fmt.Errorf("read image tarball: %w", err)
+	}
+	for _, descriptor := range manifest {
+		e.Layers = append(e.Layers, descriptor.Layers...)
+		if len(descriptor.RepoTags) > 0 && e.CreatedBy == "" {
+			e.CreatedBy = "FROM " + descriptor.RepoTags[0]
+		}
+	}
+
+	return nil
+}
+
+// readLayout reads a cached layer stored as OCI image layout
+func (e *CacheEntry) readLayout(path string) error {
+	e.Kind = CacheEntryLayer
+	e.paths = []string{path}
+
+	layoutPath, err := layout.FromPath(path)
+	if err != nil {
+		return fmt.Errorf("read layout: %w", err)
+	}
+	index, err := layoutPath.ImageIndex()
+	if err != nil {
+		return fmt.Errorf("read layout index: %w", err)
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("read layout index: %w", err)
+	}
+
+	for _, descriptor := range indexManifest.Manifests {
+		e.Digest = descriptor.Digest.String()
+		image, err := layoutPath.Image(descriptor.Digest)
+		if err != nil {
+			return fmt.Errorf("read image %s: %w", descriptor.Digest, err)
+		}
+
+		configFile, err := image.ConfigFile()
+		if err != nil {
+			return fmt.Errorf("read image config %s: %w", descriptor.Digest, err)
+		}
+		for _, history := range configFile.History {
+			if history.CreatedBy != "" {
+				e.CreatedBy = history.CreatedBy
+			}
+		}
+
+		manifest, err := image.Manifest()
+		if err != nil {
+			return fmt.Errorf("read image manifest %s: %w", descriptor.Digest, err)
+		}
+		for _, layer := range manifest.Layers {
+			e.Layers = append(e.Layers, layer.Digest.String())
+		}
+	}
+
+	return nil
+}
+
+// remove deletes all files that belong to the entry
+func (e *CacheEntry) remove() error {
+	for _, path := range append(e.paths, e.usedPath) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PruneOptions configure which cache entries are removed
+type PruneOptions struct {
+	CacheTTL  time.Duration
+	OlderThan time.Duration
+	MaxSize   int64
+}
+
+// pruneCache removes expired entries, entries that were not used within OlderThan and the least
+// recently used entries until the cache is smaller than MaxSize. It returns the removed entries.
+func pruneCache(cacheDir string, options PruneOptions) ([]*CacheEntry, error) {
+	entries, err := listCacheEntries(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// least recently used entries first
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	var totalSize int64
+	for _, entry := range entries {
+		totalSize += entry.Size
+	}
+
+	removed := []*CacheEntry{}
+	for _, entry := range entries {
+		remove := entry.expired(options.CacheTTL) ||
+			(options.OlderThan > 0 && time.Since(entry.LastUsed) > options.OlderThan) ||
+			(options.MaxSize > 0 && totalSize > options.MaxSize)
+		if !remove {
+			continue
+		}
+
+		err = entry.remove()
+		if err != nil {
+			return removed, fmt.Errorf("remove cache entry %s: %w", entry.Key, err)
+		}
+
+		totalSize -= entry.Size
+		removed = append(removed, entry)
+	}
+
+	return removed, nil
+}
+
+// markCacheEntriesUsed records that a build has used the given entries, so they are pruned last.
+// Access times are not used for this, as most filesystems are mounted with noatime or relatime.
+func markCacheEntriesUsed(cacheDir string, keys []string) error {
+	err := os.MkdirAll(filepath.Join(cacheDir, lastUsedDir), 0755)
+	if err != nil {
+		return fmt.Errorf("create last used dir: %w", err)
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		if key == "" || strings.ContainsRune(key, filepath.Separator) || !fileExists(filepath.Join(cacheDir, key)) {
+			continue
+		}
+
+		usedPath := filepath.Join(cacheDir, lastUsedDir, key)
+		file, err := os.OpenFile(usedPath, os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return fmt.Errorf("mark cache entry %s as used: %w", key, err)
+		}
+		_ = file.Close()
+
+		err = os.Chtimes(usedPath, now, now)
+		if err != nil {
+			return fmt.Errorf("mark cache entry %s as used: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// diskUsage returns the size of a file or all files in a directory
+func diskUsage(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
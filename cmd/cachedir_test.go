@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeCacheEntry writes a base image or layer entry and sets its modification time to created
+func writeCacheEntry(t *testing.T, cacheDir, key string, kind CacheEntryKind, created time.Time) {
+	t.Helper()
+
+	path := filepath.Join(cacheDir, key)
+	image := testImage(t, map[string]string{key: key})
+	var err error
+	if kind == CacheEntryBaseImage {
+		err = writeCachedBaseImage(path, "ubuntu:22.04", image)
+	} else {
+		err = writeCachedLayer(path, image)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chtimes(path, created, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadCacheEntry(t *testing.T) {
+	cacheDir := t.TempDir()
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeCacheEntry(t, cacheDir, "sha256:base", CacheEntryBaseImage, created)
+	writeCacheEntry(t, cacheDir, "layer:abc", CacheEntryLayer, created)
+
+	entries, err := listCacheEntries(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	layer, base := entries[0], entries[1]
+	if base.Kind != CacheEntryBaseImage || base.CreatedBy != "FROM ubuntu:22.04" || len(base.Layers) != 1 {
+		t.Fatalf("unexpected base image entry %+v", base)
+	} else if layer.Kind != CacheEntryLayer || layer.Digest == "" || len(layer.Layers) != 1 {
+		t.Fatalf("unexpected layer entry %+v", layer)
+	}
+	for _, entry := range entries {
+		if !entry.Created.Equal(created) || !entry.LastUsed.Equal(created) || entry.Size == 0 {
+			t.Fatalf("unexpected times or size of %s: %+v", entry.Key, entry)
+		}
+	}
+
+	_, err = readCacheEntry(cacheDir, "../sha256:base")
+	if err == nil {
+		t.Fatal("expected error for key outside of the cache dir")
+	}
+}
+
+func TestMarkCacheEntriesUsed(t *testing.T) {
+	cacheDir := t.TempDir()
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeCacheEntry(t, cacheDir, "sha256:base", CacheEntryBaseImage, created)
+
+	err := markCacheEntriesUsed(cacheDir, []string{"sha256:base", "sha256:missing", "../escape"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := readCacheEntry(cacheDir, "sha256:base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// kaniko expires entries by their modification time, so it must not change
+	if !entry.Created.Equal(created) {
+		t.Fatalf("expected created time %s to be kept, got %s", created, entry.Created)
+	} else if time.Since(entry.LastUsed) > time.Minute {
+		t.Fatalf("expected entry to be used just now, got %s", entry.LastUsed)
+	}
+	if fileExists(filepath.Join(cacheDir, lastUsedDir, "sha256:missing")) {
+		t.Fatal("expected missing entries not to be marked")
+	}
+
+	entries, err := listCacheEntries(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Fatalf("expected the last used records to be skipped, got %d entries", len(entries))
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		options PruneOptions
+		used    []string
+		want    []string
+	}{
+		{
+			name:    "expired",
+			options: PruneOptions{CacheTTL: 90 * time.Minute},
+			want:    []string{"layer:old"},
+		},
+		{
+			name:    "older than",
+			options: PruneOptions{CacheTTL: defaultCacheTTL, OlderThan: 30 * time.Minute},
+			want:    []string{"layer:new", "layer:old"},
+		},
+		{
+			name:    "recently used entries are kept",
+			options: PruneOptions{CacheTTL: defaultCacheTTL, OlderThan: 30 * time.Minute},
+			used:    []string{"layer:old"},
+			want:    []string{"layer:new"},
+		},
+		{
+			name:    "least recently used first",
+			options: PruneOptions{CacheTTL: defaultCacheTTL, MaxSize: 1},
+			used:    []string{"layer:old"},
+			want:    []string{"layer:new", "sha256:base", "layer:old"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			writeCacheEntry(t, cacheDir, "layer:old", CacheEntryLayer, now.Add(-2*time.Hour))
+			writeCacheEntry(t, cacheDir, "layer:new", CacheEntryLayer, now.Add(-time.Hour))
+			writeCacheEntry(t, cacheDir, "sha256:base", CacheEntryBaseImage, now.Add(-10*time.Minute))
+			err := markCacheEntriesUsed(cacheDir, test.used)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			removed, err := pruneCache(cacheDir, test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := []string{}
+			for _, entry := range removed {
+				keys = append(keys, entry.Key)
+				if fileExists(filepath.Join(cacheDir, entry.Key)) || fileExists(entry.usedPath) {
+					t.Fatalf("expected %s to be removed", entry.Key)
+				}
+			}
+			if test.name == "least recently used first" {
+				if !reflect.DeepEqual(keys, test.want) {
+					t.Fatalf("expected removal order %v, got %v", test.want, keys)
+				}
+				return
+			}
+
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, test.want) {
+				t.Fatalf("expected %v to be removed, got %v", test.want, keys)
+			}
+		})
+	}
+}
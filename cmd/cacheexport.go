@@ -0,0 +1,549 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/spf13/cobra"
+)
+
+const (
+	cacheFormatTar = "tar"
+	cacheFormatOCI = "oci"
+)
+
+// annotations used to restore cache entries from an OCI layout
+const (
+	cacheKindAnnotation    = "sh.loft.dockerless.cache.kind"
+	cacheImageAnnotation   = "sh.loft.dockerless.cache.image"
+	cacheCreatedAnnotation = "org.opencontainers.image.created"
+)
+
+var ErrInvalidCacheArchive = errors.New("invalid cache archive")
+
+type CacheExportCmd struct {
+	CacheDir       string
+	SharedCacheDir string
+	Format         string
+}
+
+// NewCacheExportCmd returns a new cache export command
+func NewCacheExportCmd() *cobra.Command {
+	cmd := &CacheExportCmd{}
+	cobraCmd := &cobra.Command{
+		Use:           "export FILE",
+		Short:         "Exports the local build cache into a tarball or OCI layout",
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			return cmd.Run(args[0])
+		},
+	}
+
+	cobraCmd.Flags().StringVar(&cmd.CacheDir, "cache-dir", defaultCacheDir, "The local cache directory.")
+	cobraCmd.Flags().StringVar(&cmd.SharedCacheDir, "cache-dir-shared", "", "Shared layer cache, e.g. oci:/mnt/cache, to export the cached layers from. Defaults to DOCKERLESS_CACHE_DIR_SHARED.")
+	cobraCmd.Flags().StringVar(&cmd.Format, "format", cacheFormatTar, "Either tar to write a tarball (gzip compressed if FILE ends with .gz or .tgz) or oci to write an OCI image layout directory.")
+	return cobraCmd
+}
+
+func (cmd *CacheExportCmd) Run(path string) error {
+	// base images are cached in the cache dir, while layers are only cached in the shared cache dir
+	cacheDirs := []string{cmd.CacheDir}
+	if sharedCacheDir := resolveSharedCacheDir(cmd.SharedCacheDir); sharedCacheDir != "" {
+		cacheDirs = append(cacheDirs, sharedCacheDir)
+	}
+
+	entries := []*CacheEntry{}
+	for _, cacheDir := range cacheDirs {
+		// make sure no entries are removed while we export them
+		lock, err := lockCacheDir(cacheDir, false)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+
+		dirEntries, err := listCacheEntries(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, dirEntries...)
+	}
+
+	var err error
+	switch cmd.Format {
+	case cacheFormatTar:
+		err = exportCacheTar(path, entries)
+	case cacheFormatOCI:
+		err = exportCacheLayout(path, entries)
+	default:
+		return fmt.Errorf("invalid --format %s: must be either tar or oci", cmd.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("exported %d cache entries to %s\n", len(entries), path)
+	return nil
+}
+
+type CacheImportCmd struct {
+	CacheDir       string
+	SharedCacheDir string
+}
+
+// NewCacheImportCmd returns a new cache import command
+func NewCacheImportCmd() *cobra.Command {
+	cmd := &CacheImportCmd{}
+	cobraCmd := &cobra.Command{
+		Use:           "import FILE",
+		Short:         "Imports a tarball or OCI layout created by cache export into the local build cache",
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			return cmd.Run(args[0])
+		},
+	}
+
+	cobraCmd.Flags().StringVar(&cmd.CacheDir, "cache-dir", defaultCacheDir, "The local cache directory.")
+	cobraCmd.Flags().StringVar(&cmd.SharedCacheDir, "cache-dir-shared", "", "Shared layer cache, e.g. oci:/mnt/cache, to import the cached layers into. Defaults to DOCKERLESS_CACHE_DIR_SHARED.")
+	return cobraCmd
+}
+
+func (cmd *CacheImportCmd) Run(path string) error {
+	// make sure we do not replace entries a running build is using
+	lock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// the cache dir might be shared with builds in other containers
+	cacheLock, err := lockCacheDir(cmd.CacheDir, true)
+	if err != nil {
+		return err
+	}
+	defer cacheLock.Unlock()
+
+	// layers are only used by builds from the shared cache dir
+	layerDir := cmd.CacheDir
+	if sharedCacheDir := resolveSharedCacheDir(cmd.SharedCacheDir); sharedCacheDir != "" {
+		sharedLock, err := lockCacheDir(sharedCacheDir, true)
+		if err != nil {
+			return err
+		}
+		defer sharedLock.Unlock()
+
+		layerDir = sharedCacheDir
+	}
+
+	// entries are unpacked into a temporary directory first, so we never leave half imported entries behind
+	importDir, err := os.MkdirTemp(cmd.CacheDir, ".import-*")
+	if err != nil {
+		return fmt.Errorf("create temporary import dir: %w", err)
+	}
+	defer os.RemoveAll(importDir)
+
+	if fileExists(filepath.Join(path, "index.json")) {
+		err = importCacheLayout(importDir, path)
+	} else {
+		err = importCacheTar(importDir, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, layers, err := moveCacheEntries(importDir, cmd.CacheDir, layerDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d cache entries from %s\n", len(keys), path)
+	if layers > 0 && layerDir == cmd.CacheDir {
+		fmt.Printf("warning: builds only use the %d imported layers if %s is passed as --cache-dir-shared\n", layers, cmd.CacheDir)
+	}
+	return nil
+}
+
+// exportCacheTar writes all files of the entries with their cache keys as names and keeps their
+// modification times, as kaniko uses them to expire cached entries.
+func exportCacheTar(path string, entries []*CacheEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create cache archive: %w", err)
+	}
+	defer file.Close()
+
+	var writer io.Writer = file
+	var gzipWriter *gzip.Writer
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		gzipWriter = gzip.NewWriter(file)
+		writer = gzipWriter
+	}
+
+	tarWriter := tar.NewWriter(writer)
+	for _, entry := range entries {
+		for _, entryPath := range entry.paths {
+			err = filepath.WalkDir(entryPath, func(filePath string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+
+				return addFileToTar(tarWriter, filepath.Dir(entryPath), filePath, d)
+			})
+			if err != nil {
+				return fmt.Errorf("export cache entry %s: %w", entry.Key, err)
+			}
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return fmt.Errorf("write cache archive: %w", err)
+	}
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			return fmt.Errorf("write cache archive: %w", err)
+		}
+	}
+
+	return file.Close()
+}
+
+func addFileToTar(tarWriter *tar.Writer, baseDir, filePath string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	} else if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil
+	}
+
+	relPath, err := filepath.Rel(baseDir, filePath)
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(relPath)
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	err = tarWriter.WriteHeader(header)
+	if err != nil || info.IsDir() {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
+
+// importCacheTar unpacks a (gzip compressed) tarball written by exportCacheTar into dir
+func importCacheTar(dir, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open cache archive: %w", err)
+	}
+	defer file.Close()
+
+	reader, err := decompressStream(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("read cache archive: %w", err)
+	}
+
+	modTimes := map[string]time.Time{}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read cache archive: %w", err)
+		}
+
+		// only accept plain files and directories within the cache dir
+		if !filepath.IsLocal(header.Name) || strings.HasPrefix(header.Name, ".") {
+			return fmt.Errorf("%w: unexpected path %s", ErrInvalidCacheArchive, header.Name)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = extractTarFile(tarReader, target)
+		default:
+			return fmt.Errorf("%w: unexpected file type of %s", ErrInvalidCacheArchive, header.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("extract %s: %w", header.Name, err)
+		}
+
+		modTimes[target] = header.ModTime
+	}
+
+	// restore the modification times after all files were written, as writing files changes the times of their directories
+	for target, modTime := range modTimes {
+		err = os.Chtimes(target, modTime, modTime)
+		if err != nil {
+			return fmt.Errorf("restore modification time of %s: %w", target, err)
+		}
+	}
+
+	return nil
+}
+
+func extractTarFile(reader io.Reader, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// exportCacheLayout writes every entry as image into an OCI layout. The cache key is stored
+// as ref name, so the entries can be restored with the same keys.
+func exportCacheLayout(path string, entries []*CacheEntry) error {
+	layoutPath, err := layout.Write(path, empty.Index)
+	if err != nil {
+		return fmt.Errorf("write empty layout: %w", err)
+	}
+
+	for _, entry := range entries {
+		image, err := entry.image()
+		if err != nil {
+			return fmt.Errorf("export cache entry %s: %w", entry.Key, err)
+		}
+
+		annotations := map[string]string{
+			ociRefNameAnnotation:   entry.Key,
+			cacheKindAnnotation:    string(entry.Kind),
+			cacheCreatedAnnotation: entry.Created.UTC().Format(time.RFC3339Nano),
+		}
+		if entry.Kind == CacheEntryBaseImage {
+			annotations[cacheImageAnnotation] = strings.TrimPrefix(entry.CreatedBy, "FROM ")
+		}
+
+		err = layoutPath.AppendImage(image, layout.WithAnnotations(annotations))
+		if err != nil {
+			return fmt.Errorf("export cache entry %s: %w", entry.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// importCacheLayout restores all entries of an OCI layout written by exportCacheLayout into dir
+func importCacheLayout(dir, path string) error {
+	layoutPath, err := layout.FromPath(path)
+	if err != nil {
+		return fmt.Errorf("read layout: %w", err)
+	}
+	index, err := layoutPath.ImageIndex()
+	if err != nil {
+		return fmt.Errorf("read layout index: %w", err)
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("read layout index: %w", err)
+	}
+
+	for _, descriptor := range indexManifest.Manifests {
+		key := descriptor.Annotations[ociRefNameAnnotation]
+		if key == "" || !filepath.IsLocal(key) || strings.ContainsRune(key, filepath.Separator) || strings.HasPrefix(key, ".") {
+			return fmt.Errorf("%w: unexpected cache key %q", ErrInvalidCacheArchive, key)
+		}
+
+		image, err := layoutPath.Image(descriptor.Digest)
+		if err != nil {
+			return fmt.Errorf("read cache entry %s: %w", key, err)
+		}
+
+		target := filepath.Join(dir, key)
+		switch CacheEntryKind(descriptor.Annotations[cacheKindAnnotation]) {
+		case CacheEntryBaseImage:
+			err = writeCachedBaseImage(target, descriptor.Annotations[cacheImageAnnotation], image)
+		case CacheEntryLayer:
+			err = writeCachedLayer(target, image)
+		default:
+			return fmt.Errorf("%w: unknown kind of cache entry %s", ErrInvalidCacheArchive, key)
+		}
+		if err != nil {
+			return fmt.Errorf("import cache entry %s: %w", key, err)
+		}
+
+		created, err := time.Parse(time.RFC3339Nano, descriptor.Annotations[cacheCreatedAnnotation])
+		if err != nil {
+			created = time.Now()
+		}
+		err = os.Chtimes(target, created, created)
+		if err != nil {
+			return fmt.Errorf("restore modification time of %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// image returns the image stored in the entry
+func (e *CacheEntry) image() (v1.Image, error) {
+	if e.Kind == CacheEntryBaseImage {
+		return tarball.ImageFromPath(e.paths[0], nil)
+	}
+
+	layoutPath, err := layout.FromPath(e.paths[0])
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := v1.NewHash(e.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return layoutPath.Image(digest)
+}
+
+// writeCachedBaseImage writes image in the format of the cache warmer
+func writeCachedBaseImage(path, imageName string, image v1.Image) error {
+	ref, err := name.ParseReference(imageName, name.WeakValidation)
+	if err != nil {
+		ref, _ = name.ParseReference(defaultImageName, name.WeakValidation)
+	}
+
+	manifest, err := image.RawManifest()
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path+".json", manifest, 0666)
+	if err != nil {
+		return err
+	}
+
+	return tarball.WriteToFile(path, ref, image)
+}
+
+// writeCachedLayer writes image as OCI layout, the format kaniko's layout cache expects
+func writeCachedLayer(path string, image v1.Image) error {
+	layoutPath, err := layout.Write(path, empty.Index)
+	if err != nil {
+		return err
+	}
+
+	return layoutPath.AppendImage(image)
+}
+
+// moveCacheEntries moves all entries from importDir into cacheDir and the layers into layerDir. Existing
+// entries are replaced. It returns the keys of the imported entries and how many of them are layers.
+func moveCacheEntries(importDir, cacheDir, layerDir string) ([]string, int, error) {
+	files, err := os.ReadDir(importDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read import dir: %w", err)
+	}
+
+	keys := []string{}
+	layers := 0
+	for _, file := range files {
+		// layers are stored as OCI layout directories
+		targetDir := cacheDir
+		if file.IsDir() {
+			targetDir = layerDir
+			layers++
+		}
+
+		err = moveCacheEntry(filepath.Join(importDir, file.Name()), targetDir)
+		if err != nil {
+			return keys, layers, fmt.Errorf("import cache entry %s: %w", file.Name(), err)
+		}
+
+		if !strings.HasSuffix(file.Name(), ".json") || file.IsDir() {
+			keys = append(keys, file.Name())
+		}
+	}
+
+	return keys, layers, nil
+}
+
+// moveCacheEntry moves the file or directory src into dir. If dir is on another filesystem,
+// src is copied into a temporary directory in dir first, so the entry appears atomically.
+func moveCacheEntry(src, dir string) error {
+	target := filepath.Join(dir, filepath.Base(src))
+	err := os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(src, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := os.MkdirTemp(dir, ".import-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	tempPath := filepath.Join(tempDir, filepath.Base(src))
+	if info.IsDir() {
+		err = os.Mkdir(tempPath, 0755)
+		if err == nil {
+			err = copyDir(src, tempPath)
+		}
+	} else {
+		err = copyFile(src, tempPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// kaniko expires entries by their modification time
+	err = os.Chtimes(tempPath, info.ModTime(), info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, target)
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheExportImport(t *testing.T) {
+	setupStateFiles(t)
+
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	cacheDir := t.TempDir()
+	sharedCacheDir := t.TempDir()
+	writeCacheEntry(t, cacheDir, "sha256:base", CacheEntryBaseImage, created)
+	writeCacheEntry(t, sharedCacheDir, "layer:abc", CacheEntryLayer, created)
+
+	for _, format := range []string{cacheFormatTar, cacheFormatOCI} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache")
+			if format == cacheFormatTar {
+				path += ".tar.gz"
+			}
+
+			exportCmd := &CacheExportCmd{CacheDir: cacheDir, SharedCacheDir: "oci:" + sharedCacheDir, Format: format}
+			err := exportCmd.Run(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			importCmd := &CacheImportCmd{CacheDir: t.TempDir(), SharedCacheDir: t.TempDir()}
+			err = importCmd.Run(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for dir, key := range map[string]string{importCmd.CacheDir: "sha256:base", importCmd.SharedCacheDir: "layer:abc"} {
+				entry, err := readCacheEntry(dir, key)
+				if err != nil {
+					t.Fatal(err)
+				} else if !entry.Created.Equal(created) {
+					t.Fatalf("expected %s to keep its creation time %s, got %s", key, created, entry.Created)
+				}
+			}
+			if fileExists(filepath.Join(importCmd.CacheDir, "layer:abc")) {
+				t.Fatal("expected layers to be imported into the shared cache dir")
+			}
+		})
+	}
+}
+
+func TestCacheImportWithoutSharedCacheDir(t *testing.T) {
+	setupStateFiles(t)
+
+	sharedCacheDir := t.TempDir()
+	writeCacheEntry(t, sharedCacheDir, "layer:abc", CacheEntryLayer, time.Now())
+	path := filepath.Join(t.TempDir(), "cache.tar")
+	err := (&CacheExportCmd{CacheDir: t.TempDir(), SharedCacheDir: sharedCacheDir, Format: cacheFormatTar}).Run(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importCmd := &CacheImportCmd{CacheDir: t.TempDir()}
+	err = importCmd.Run(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readCacheEntry(importCmd.CacheDir, "layer:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportCacheTarRejectsUnexpectedPaths(t *testing.T) {
+	for _, name := range []string{"../escape", ".used/sha256:base", "/etc/passwd"} {
+		path := filepath.Join(t.TempDir(), "cache.tar")
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tarWriter := tar.NewWriter(file)
+		err = tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = tarWriter.Close()
+		_ = file.Close()
+
+		err = importCacheTar(t.TempDir(), path)
+		if !errors.Is(err, ErrInvalidCacheArchive) {
+			t.Errorf("%s: expected ErrInvalidCacheArchive, got %v", name, err)
+		}
+	}
+}
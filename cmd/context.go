@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+const (
+	dirContextPrefix  = "dir://"
+	tarContextPrefix  = "tar://"
+	fileContextPrefix = "file://"
+
+	stdinContext = "-"
+)
+
+// dockerfileDownloadTimeout is how long we wait for a remote Dockerfile
+const dockerfileDownloadTimeout = 30 * time.Second
+
+var ErrUnsupportedContext = errors.New("unsupported build context")
+
+// resolveContext turns the given build context into a local directory kaniko can build from.
+// Archives and stdin streams are unpacked into the kaniko build context dir.
+func resolveContext(buildContext string) (string, error) {
+	switch {
+	case buildContext == stdinContext:
+		return unpackContextFromStdin()
+	case strings.HasPrefix(buildContext, dirContextPrefix):
+		return resolveContextDir(strings.TrimPrefix(buildContext, dirContextPrefix))
+	case strings.HasPrefix(buildContext, tarContextPrefix):
+		return unpackContextArchive(strings.TrimPrefix(buildContext, tarContextPrefix))
+	case strings.HasPrefix(buildContext, fileContextPrefix):
+		return resolveContextPath(strings.TrimPrefix(buildContext, fileContextPrefix))
+	case strings.Contains(buildContext, "://"):
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedContext, buildContext)
+	default:
+		return resolveContextPath(buildContext)
+	}
+}
+
+// resolveContextPath accepts either a directory or a local tar archive
+func resolveContextPath(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("stat build context: %w", err)
+	}
+	if stat.IsDir() {
+		return filepath.Abs(path)
+	}
+
+	return unpackContextArchive(path)
+}
+
+func resolveContextDir(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("stat build context: %w", err)
+	} else if !stat.IsDir() {
+		return "", fmt.Errorf("build context %s is not a directory", path)
+	}
+
+	return filepath.Abs(path)
+}
+
+func unpackContextArchive(path string) (string, error) {
+	if !util.IsFileLocalTarArchive(path) {
+		return "", fmt.Errorf("build context %s is not a tar archive", path)
+	}
+
+	contextDir, err := prepareContextDir()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = util.UnpackLocalTarArchive(path, contextDir)
+	if err != nil {
+		return "", fmt.Errorf("unpack build context %s: %w", path, err)
+	}
+
+	return contextDir, nil
+}
+
+func unpackContextFromStdin() (string, error) {
+	contextDir, err := prepareContextDir()
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := decompressStream(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return "", fmt.Errorf("read build context from stdin: %w", err)
+	}
+
+	_, err = util.UnTar(reader, contextDir)
+	if err != nil {
+		return "", fmt.Errorf("unpack build context from stdin: %w", err)
+	}
+
+	return contextDir, nil
+}
+
+// decompressStream detects gzip and bzip2 streams by their magic bytes
+func decompressStream(reader *bufio.Reader) (io.Reader, error) {
+	magic, err := reader.Peek(3)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(reader)
+	case len(magic) >= 3 && string(magic) == "BZh":
+		return bzip2.NewReader(reader), nil
+	default:
+		return reader, nil
+	}
+}
+
+func prepareContextDir() (string, error) {
+	contextDir := config.BuildContextDir
+	err := os.RemoveAll(contextDir)
+	if err != nil {
+		return "", fmt.Errorf("clean build context dir: %w", err)
+	}
+
+	err = os.MkdirAll(contextDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("create build context dir: %w", err)
+	}
+
+	return contextDir, nil
+}
+
+// readDockerfile reads a local Dockerfile or downloads it from a http(s) url, like kaniko does
+func readDockerfile(ctx context.Context, path string) ([]byte, error) {
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		return os.ReadFile(path)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: dockerfileDownloadTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: unexpected status %s", path, response.Status)
+	}
+
+	return io.ReadAll(response.Body)
+}
+
+// resolveDockerfile looks up a relative Dockerfile inside the build context if it cannot be found as given
+func resolveDockerfile(dockerfile, contextDir string) (string, error) {
+	if strings.HasPrefix(dockerfile, "http://") || strings.HasPrefix(dockerfile, "https://") {
+		return dockerfile, nil
+	}
+	if _, err := os.Stat(dockerfile); err == nil || filepath.IsAbs(dockerfile) {
+		return filepath.Abs(dockerfile)
+	}
+
+	inContext := filepath.Join(contextDir, dockerfile)
+	if _, err := os.Stat(inContext); err != nil {
+		return "", fmt.Errorf("find dockerfile %s: %w", dockerfile, err)
+	}
+
+	return inContext, nil
+}
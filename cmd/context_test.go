@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+)
+
+func TestResolveContext(t *testing.T) {
+	dir := t.TempDir()
+	config.BuildContextDir = filepath.Join(t.TempDir(), "buildcontext")
+
+	archive := filepath.Join(dir, "context.tar.gz")
+	err := os.WriteFile(archive, tarGz(t, map[string]string{"Dockerfile": "FROM scratch"}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file.txt")
+	err = os.WriteFile(file, []byte("no archive"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		context string
+		want    string
+		wantErr bool
+	}{
+		{name: "directory", context: dir, want: dir},
+		{name: "dir scheme", context: "dir://" + dir, want: dir},
+		{name: "dir scheme with file", context: "dir://" + archive, wantErr: true},
+		{name: "archive", context: archive, want: config.BuildContextDir},
+		{name: "tar scheme", context: "tar://" + archive, want: config.BuildContextDir},
+		{name: "file scheme", context: "file://" + archive, want: config.BuildContextDir},
+		{name: "tar scheme with plain file", context: "tar://" + file, wantErr: true},
+		{name: "missing", context: filepath.Join(dir, "missing"), wantErr: true},
+		{name: "unsupported scheme", context: "git://github.com/loft-sh/dockerless", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveContext(test.context)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %s", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Fatalf("expected %s, got %s", test.want, got)
+			}
+			if got == config.BuildContextDir {
+				if _, err := os.Stat(filepath.Join(got, "Dockerfile")); err != nil {
+					t.Fatalf("archive was not unpacked: %v", err)
+				}
+			}
+		})
+	}
+
+	_, err = resolveContext("s3://bucket/context.tar.gz")
+	if !errors.Is(err, ErrUnsupportedContext) {
+		t.Fatalf("expected ErrUnsupportedContext, got %v", err)
+	}
+}
+
+func TestDecompressStream(t *testing.T) {
+	content := tarGz(t, map[string]string{"file": "content"})
+	plain, err := io.ReadAll(mustGunzip(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, input := range map[string][]byte{"gzip": content, "plain": plain} {
+		t.Run(name, func(t *testing.T) {
+			reader, err := decompressStream(bufio.NewReader(bytes.NewReader(input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hdr, err := tar.NewReader(reader).Next()
+			if err != nil {
+				t.Fatal(err)
+			} else if hdr.Name != "file" {
+				t.Fatalf("expected file, got %s", hdr.Name)
+			}
+		})
+	}
+}
+
+func TestResolveDockerfile(t *testing.T) {
+	contextDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolveDockerfile("Dockerfile", contextDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if got != filepath.Join(contextDir, "Dockerfile") {
+		t.Fatalf("expected dockerfile in context, got %s", got)
+	}
+
+	got, err = resolveDockerfile("https://example.com/Dockerfile", contextDir)
+	if err != nil || got != "https://example.com/Dockerfile" {
+		t.Fatalf("expected url to be kept, got %s, %v", got, err)
+	}
+
+	_, err = resolveDockerfile("missing/Dockerfile", contextDir)
+	if err == nil {
+		t.Fatal("expected error for missing dockerfile")
+	}
+}
+
+func TestReadDockerfile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/Dockerfile" {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write([]byte("FROM alpine"))
+	}))
+	defer server.Close()
+
+	local := filepath.Join(t.TempDir(), "Dockerfile")
+	writeFile(t, local, "FROM ubuntu")
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: local, want: "FROM ubuntu"},
+		{path: server.URL + "/Dockerfile", want: "FROM alpine"},
+		{path: server.URL + "/missing", wantErr: true},
+		{path: local + ".missing", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := readDockerfile(context.Background(), test.path)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.path)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+
+		if string(got) != test.want {
+			t.Errorf("%s: expected %q, got %q", test.path, test.want, got)
+		}
+	}
+}
+
+func TestReadDockerfileCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := readDockerfile(ctx, server.URL+"/Dockerfile")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func tarGz(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tarWriter.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func mustGunzip(t *testing.T, content []byte) io.Reader {
+	t.Helper()
+
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reader
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
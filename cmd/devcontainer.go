@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// DevContainerConfig is the part of a devcontainer.json that describes how to build the image
+type DevContainerConfig struct {
+	Name            string             `json:"name,omitempty"`
+	Image           string             `json:"image,omitempty"`
+	Build           *DevContainerBuild `json:"build,omitempty"`
+	WorkspaceFolder string             `json:"workspaceFolder,omitempty"`
+	ContainerUser   string             `json:"containerUser,omitempty"`
+	RemoteUser      string             `json:"remoteUser,omitempty"`
+
+	// Features maps the Feature references to their options, which are either an object, a version string or true
+	Features                    map[string]interface{} `json:"features,omitempty"`
+	OverrideFeatureInstallOrder []string               `json:"overrideFeatureInstallOrder,omitempty"`
+
+	// DockerFile and Context are the deprecated top level build properties
+	DockerFile string `json:"dockerFile,omitempty"`
+	Context    string `json:"context,omitempty"`
+
+	// path is the absolute path of the devcontainer.json
+	path string
+}
+
+// DevContainerBuild are the build properties of a devcontainer.json
+type DevContainerBuild struct {
+	Dockerfile string            `json:"dockerfile,omitempty"`
+	Context    string            `json:"context,omitempty"`
+	Args       map[string]string `json:"args,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	CacheFrom  stringList        `json:"cacheFrom,omitempty"`
+}
+
+// stringList is a json property that is either a single string or a list of strings
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	single := ""
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = stringList{single}
+		return nil
+	}
+
+	list := []string{}
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("expected a string or a list of strings")
+	}
+
+	*l = list
+	return nil
+}
+
+var devContainerVariableRegEx = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// readDevContainerConfig reads a devcontainer.json with comments and substitutes its variables
+func readDevContainerConfig(path string) (*DevContainerConfig, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read devcontainer.json: %w", err)
+	}
+
+	var raw interface{}
+	err = json.Unmarshal(stripJSONComments(content), &raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	// the container workspace folder might be configured in the file itself with local variables,
+	// so we need to know it first
+	localWorkspaceFolder := devContainerWorkspaceFolder(path)
+	variables := map[string]string{
+		"localWorkspaceFolder":         localWorkspaceFolder,
+		"localWorkspaceFolderBasename": filepath.Base(localWorkspaceFolder),
+	}
+	containerWorkspaceFolder := "/workspaces/" + filepath.Base(localWorkspaceFolder)
+	if object, ok := raw.(map[string]interface{}); ok {
+		if workspaceFolder, ok := object["workspaceFolder"].(string); ok && workspaceFolder != "" {
+			containerWorkspaceFolder = substituteDevContainerVariables(workspaceFolder, variables).(string)
+		}
+	}
+	variables["containerWorkspaceFolder"] = containerWorkspaceFolder
+	variables["containerWorkspaceFolderBasename"] = filepath.Base(containerWorkspaceFolder)
+
+	substituted, err := json.Marshal(substituteDevContainerVariables(raw, variables))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &DevContainerConfig{path: path}
+	err = json.Unmarshal(substituted, config)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// devContainerWorkspaceFolder returns the folder that contains the .devcontainer folder or the folder of the devcontainer.json
+func devContainerWorkspaceFolder(path string) string {
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if filepath.Base(dir) == ".devcontainer" {
+			return filepath.Dir(dir)
+		}
+	}
+
+	return filepath.Dir(path)
+}
+
+// substituteDevContainerVariables replaces variables such as ${localWorkspaceFolder} and ${localEnv:NAME:default}
+// in all strings of value. Variables that are only known when the container runs, such as ${containerEnv:NAME}, are kept.
+func substituteDevContainerVariables(value interface{}, variables map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return devContainerVariableRegEx.ReplaceAllStringFunc(v, func(match string) string {
+			variable := match[2 : len(match)-1]
+			if value, ok := variables[variable]; ok {
+				return value
+			}
+
+			kind, rest, _ := strings.Cut(variable, ":")
+			if kind == "localEnv" || kind == "env" {
+				name, defaultValue, _ := strings.Cut(rest, ":")
+				if value, ok := os.LookupEnv(name); ok {
+					return value
+				}
+
+				return defaultValue
+			}
+
+			return match
+		})
+	case []interface{}:
+		for i := range v {
+			v[i] = substituteDevContainerVariables(v[i], variables)
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = substituteDevContainerVariables(v[key], variables)
+		}
+	}
+
+	return value
+}
+
+// stripJSONComments turns JSONC into JSON by removing comments and trailing commas outside of strings
+func stripJSONComments(content []byte) []byte {
+	return removeTrailingCommas(removeJSONComments(content))
+}
+
+func removeJSONComments(content []byte) []byte {
+	out := &bytes.Buffer{}
+	inString := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case inString:
+			out.WriteByte(c)
+			if c == '\\' && i+1 < len(content) {
+				i++
+				out.WriteByte(content[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+		case c == '/' && i+1 < len(content) && content[i+1] == '/':
+			for i+1 < len(content) && content[i+1] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(content) && content[i+1] == '*':
+			end := bytes.Index(content[i+2:], []byte("*/"))
+			if end < 0 {
+				return out.Bytes()
+			}
+			i += end + 3
+			out.WriteByte(' ')
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return out.Bytes()
+}
+
+func removeTrailingCommas(content []byte) []byte {
+	out := &bytes.Buffer{}
+	inString := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case inString:
+			out.WriteByte(c)
+			if c == '\\' && i+1 < len(content) {
+				i++
+				out.WriteByte(content[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+		case c == ',':
+			next := bytes.TrimLeft(content[i+1:], " \t\r\n")
+			if len(next) > 0 && (next[0] == '}' || next[0] == ']') {
+				continue
+			}
+			out.WriteByte(c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return out.Bytes()
+}
+
+// applyDevContainerConfig fills all build options that were not set through flags or the environment from the devcontainer.json
+func (cmd *BuildCmd) applyDevContainerConfig(config *DevContainerConfig) error {
+	build := config.Build
+	if build == nil {
+		build = &DevContainerBuild{}
+	}
+	if build.Dockerfile == "" {
+		build.Dockerfile = config.DockerFile
+	}
+	if build.Context == "" {
+		build.Context = config.Context
+	}
+	if build.Dockerfile == "" {
+		return fmt.Errorf("%s does not specify build.dockerfile", config.path)
+	}
+
+	// paths are relative to the devcontainer.json
+	configDir := filepath.Dir(config.path)
+	if cmd.Dockerfile == "" {
+		cmd.Dockerfile = resolvePath(configDir, build.Dockerfile)
+	}
+	if cmd.Context == "" {
+		cmd.Context = resolvePath(configDir, build.Context)
+	}
+	if cmd.Target == "" {
+		cmd.Target = build.Target
+	}
+
+	// the devcontainer args have the lowest precedence
+	names := make([]string, 0, len(build.Args))
+	for name := range build.Args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buildArgs := []string{}
+	for _, name := range names {
+		buildArgs = append(buildArgs, name+"="+build.Args[name])
+	}
+	cmd.devContainerBuildArgs = buildArgs
+	cmd.devContainer = config
+
+	// kaniko supports a single cache repo, which is a repository without tag. It looks up a tag per
+	// cache key in it, so the layers of the cacheFrom image itself are never reused. As
+	// --export-cache pushes these tags, we only use cacheFrom as cache repo if the build sets it.
+	if cmd.RegistryCache == "" && cmd.SharedCacheDir == "" && len(build.CacheFrom) > 0 {
+		if !cmd.ExportCache {
+			fmt.Printf("warning: ignoring cacheFrom of %s, use --export-cache to use it as layer cache repository\n", config.path)
+			return nil
+		} else if len(build.CacheFrom) > 1 {
+			fmt.Printf("warning: only using the first cacheFrom entry %s of %s\n", build.CacheFrom[0], config.path)
+		}
+
+		cmd.RegistryCache = build.CacheFrom[0]
+		if !strings.HasPrefix(cmd.RegistryCache, ociCachePrefix) {
+			ref, err := name.ParseReference(cmd.RegistryCache, name.WeakValidation)
+			if err != nil {
+				return fmt.Errorf("parse cacheFrom %s: %w", cmd.RegistryCache, err)
+			}
+
+			cmd.RegistryCache = ref.Context().Name()
+		}
+		fmt.Printf("using cacheFrom %s as layer cache repository %s\n", build.CacheFrom[0], cmd.RegistryCache)
+	}
+
+	return nil
+}
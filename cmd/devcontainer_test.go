@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStripJSONComments(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "plain", input: `{"a": 1}`, want: `{"a": 1}`},
+		{name: "line comment", input: "{\n// comment\n\"a\": 1}", want: "{\n\n\"a\": 1}"},
+		{name: "block comment", input: `{/* comment */"a": 1}`, want: `{ "a": 1}`},
+		{name: "comment in string", input: `{"a": "http://example.com/*x*/"}`, want: `{"a": "http://example.com/*x*/"}`},
+		{name: "escaped quote", input: `{"a": "\"//"}`, want: `{"a": "\"//"}`},
+		{name: "trailing commas", input: "{\"a\": [1, 2,\n],\n}", want: "{\"a\": [1, 2\n]\n}"},
+		{name: "comma in string", input: `{"a": ",}"}`, want: `{"a": ",}"}`},
+		{name: "comma before comment", input: "{\"a\": 1, // comment\n}", want: "{\"a\": 1 \n}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(stripJSONComments([]byte(test.input)))
+			if got != test.want {
+				t.Fatalf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestStringList(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    stringList
+		wantErr bool
+	}{
+		{input: `"image"`, want: stringList{"image"}},
+		{input: `["a", "b"]`, want: stringList{"a", "b"}},
+		{input: `1`, wantErr: true},
+	}
+	for _, test := range tests {
+		list := stringList{}
+		err := json.Unmarshal([]byte(test.input), &list)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.input)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(list, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.input, test.want, list)
+		}
+	}
+}
+
+func TestReadDevContainerConfig(t *testing.T) {
+	workspace := filepath.Join(t.TempDir(), "project")
+	path := filepath.Join(workspace, ".devcontainer", "devcontainer.json")
+	writeFile(t, path, `{
+	// the build of the workspace
+	"build": {
+		"dockerfile": "Dockerfile",
+		"args": {
+			"WORKSPACE": "${localWorkspaceFolderBasename}",
+			"CONTAINER": "${containerWorkspaceFolder}",
+			"USER": "${localEnv:TEST_DEVCONTAINER_USER}",
+			"SHELL": "${localEnv:TEST_DEVCONTAINER_MISSING:bash}",
+			"REMOTE": "${containerEnv:PATH}",
+		},
+		"cacheFrom": "my.registry/app:latest",
+	},
+	"workspaceFolder": "/src/${localWorkspaceFolderBasename}",
+}`)
+	t.Setenv("TEST_DEVCONTAINER_USER", "dev")
+
+	config, err := readDevContainerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"WORKSPACE": "project",
+		"CONTAINER": "/src/project",
+		"USER":      "dev",
+		"SHELL":     "bash",
+		"REMOTE":    "${containerEnv:PATH}",
+	}
+	if !reflect.DeepEqual(config.Build.Args, want) {
+		t.Fatalf("expected args %v, got %v", want, config.Build.Args)
+	}
+	if !reflect.DeepEqual(config.Build.CacheFrom, stringList{"my.registry/app:latest"}) {
+		t.Fatalf("unexpected cacheFrom %v", config.Build.CacheFrom)
+	}
+	if config.path != path {
+		t.Fatalf("expected path %s, got %s", path, config.path)
+	}
+
+	writeFile(t, path, `{"build": `)
+	_, err = readDevContainerConfig(path)
+	if err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+}
+
+func TestApplyDevContainerConfig(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), ".devcontainer")
+	config := &DevContainerConfig{
+		path: filepath.Join(dir, "devcontainer.json"),
+		Build: &DevContainerBuild{
+			Dockerfile: "Dockerfile",
+			Context:    "..",
+			Target:     "dev",
+			Args:       map[string]string{"B": "2", "A": "1"},
+			CacheFrom:  stringList{"my.registry/app:latest", "my.registry/other"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		cmd  BuildCmd
+		want BuildCmd
+	}{
+		{
+			name: "devcontainer",
+			want: BuildCmd{
+				Dockerfile: filepath.Join(dir, "Dockerfile"),
+				Context:    filepath.Dir(dir),
+				Target:     "dev",
+			},
+		},
+		{
+			name: "cacheFrom with exported cache",
+			cmd:  BuildCmd{ExportCache: true},
+			want: BuildCmd{
+				Dockerfile:    filepath.Join(dir, "Dockerfile"),
+				Context:       filepath.Dir(dir),
+				Target:        "dev",
+				RegistryCache: "my.registry/app",
+			},
+		},
+		{
+			name: "flags or env take precedence",
+			cmd:  BuildCmd{Dockerfile: "/Dockerfile", Context: "/context", Target: "prod", RegistryCache: "my.registry/cache", ExportCache: true},
+			want: BuildCmd{Dockerfile: "/Dockerfile", Context: "/context", Target: "prod", RegistryCache: "my.registry/cache"},
+		},
+		{
+			name: "shared cache dir",
+			cmd:  BuildCmd{SharedCacheDir: "/mnt/cache", ExportCache: true},
+			want: BuildCmd{
+				Dockerfile:     filepath.Join(dir, "Dockerfile"),
+				Context:        filepath.Dir(dir),
+				Target:         "dev",
+				SharedCacheDir: "/mnt/cache",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := test.cmd
+			err := cmd.applyDevContainerConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cmd.Dockerfile != test.want.Dockerfile || cmd.Context != test.want.Context || cmd.Target != test.want.Target {
+				t.Fatalf("expected %s %s %s, got %s %s %s", test.want.Dockerfile, test.want.Context, test.want.Target, cmd.Dockerfile, cmd.Context, cmd.Target)
+			}
+			if cmd.RegistryCache != test.want.RegistryCache || cmd.SharedCacheDir != test.want.SharedCacheDir {
+				t.Fatalf("expected cache %q %q, got %q %q", test.want.RegistryCache, test.want.SharedCacheDir, cmd.RegistryCache, cmd.SharedCacheDir)
+			}
+			if !reflect.DeepEqual(cmd.devContainerBuildArgs, []string{"A=1", "B=2"}) {
+				t.Fatalf("unexpected build args %v", cmd.devContainerBuildArgs)
+			}
+		})
+	}
+
+	cmd := BuildCmd{}
+	err := cmd.applyDevContainerConfig(&DevContainerConfig{path: config.path, Image: "ubuntu"})
+	if err == nil {
+		t.Fatal("expected error for devcontainer.json without dockerfile")
+	}
+}
+
+func TestBuildPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "devcontainer.json")
+	writeFile(t, path, `{"build": {"dockerfile": "Dockerfile", "target": "dev", "cacheFrom": "my.registry/app"}}`)
+	t.Setenv("DOCKERLESS_DEVCONTAINER", path)
+	t.Setenv("DOCKERLESS_TARGET", "prod")
+	t.Setenv("DOCKERLESS_CACHE_DIR_SHARED", "/mnt/cache")
+	t.Setenv("DOCKERLESS_DOCKERFILE", "")
+	t.Setenv("DOCKERLESS_CONTEXT", "")
+
+	// the build fails later on, because the context does not exist
+	cmd := &BuildCmd{Context: filepath.Join(dir, "missing")}
+	err := cmd.run(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "resolve context") {
+		t.Fatalf("expected error for missing context, got %v", err)
+	}
+
+	if cmd.Target != "prod" {
+		t.Fatalf("expected env target prod, got %s", cmd.Target)
+	}
+	if cmd.RegistryCache != "" || cmd.sharedCacheDir != "/mnt/cache" {
+		t.Fatalf("expected shared cache dir from env, got %q %q", cmd.RegistryCache, cmd.sharedCacheDir)
+	}
+	if cmd.Dockerfile != filepath.Join(dir, "Dockerfile") {
+		t.Fatalf("expected dockerfile of the devcontainer.json, got %s", cmd.Dockerfile)
+	}
+}
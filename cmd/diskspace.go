@@ -0,0 +1,394 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// uncompressedSizeRatio estimates the size of an extracted layer from its compressed size, as image
+// manifests only contain the compressed size. Filesystem layers usually compress by a factor of 2-3.
+const uncompressedSizeRatio = 3
+
+// DiskUsageOutput records the space the previous build needed besides its base images, which we
+// cannot know before building
+var DiskUsageOutput = "/.dockerless/disk-usage.json"
+
+var ErrNotEnoughDiskSpace = errors.New("not enough disk space")
+
+// diskUsageRecord is the space the previous build used besides its base images
+type diskUsageRecord struct {
+	// BuiltLayers is the size of the layers the build added to the final stage
+	BuiltLayers int64 `json:"builtLayers"`
+	// StageFiles is the size of the stage tarballs and the files kaniko saved for COPY --from
+	StageFiles int64 `json:"stageFiles"`
+}
+
+// diskSpaceEstimate is the disk space a build needs
+type diskSpaceEstimate struct {
+	// RootFS is the size of the largest extracted stage on /, including the built layers. It does
+	// not contain the base image layers that are reused.
+	RootFS int64
+	// Reused is the size of the base image layers that stay on /, so deleting the filesystem does not free them
+	Reused int64
+	// FinalBase is the size of the extracted base image of the final stage
+	FinalBase int64
+	// Workspace is the size of the snapshots of the built layers, the stage tarballs and the files
+	// kaniko saves for COPY --from below /.dockerless
+	Workspace int64
+	// Persist is the size of the persisted paths, which are copied to /.dockerless and restored to /
+	Persist int64
+}
+
+// diskSpaceCheck compares the space needed on a filesystem with the space that is available
+type diskSpaceCheck struct {
+	path      string
+	dev       uint64
+	needed    []string
+	need      int64
+	available int64
+}
+
+// checkDiskSpace resolves the base images and makes sure the build fits on / and /.dockerless, so
+// we do not delete the filesystem if the build would fail halfway through extracting the layers
+func (cmd *BuildCmd) checkDiskSpace(opts *config.KanikoOptions, images *baseImageResolver) (*diskSpaceEstimate, error) {
+	estimate, err := estimateDiskSpace(opts, images, cmd.PersistPaths)
+	if err != nil {
+		return nil, fmt.Errorf("estimate disk space: %w", err)
+	}
+
+	root, err := statDiskSpace(config.RootDir)
+	if err != nil {
+		return nil, fmt.Errorf("check disk space of %s: %w", config.RootDir, err)
+	}
+	root.add("base images and built layers", estimate.RootFS)
+	root.add("persisted paths", estimate.Persist)
+
+	dockerless, err := statDiskSpace(config.KanikoDir)
+	if err != nil || dockerless.dev == root.dev {
+		dockerless = root
+	}
+	dockerless.add("kaniko workspace", estimate.Workspace)
+	dockerless.add("persisted path copies", estimate.Persist)
+
+	// kaniko overwrites the stage files of the previous build, so their space is available again
+	dockerless.available += stageFilesUsage()
+
+	// the current filesystem is deleted before extracting, so we only count it if we need to
+	if root.need > root.available {
+		reclaimable := reclaimableSpace(root.dev) - estimate.Reused
+		if reclaimable > 0 {
+			root.available += reclaimable
+		}
+	}
+
+	for _, check := range []*diskSpaceCheck{root, dockerless} {
+		if check.need > check.available {
+			return nil, fmt.Errorf("%w on %s: the build needs an estimated %s (%s), but only %s are available after deleting the current filesystem, about %s are missing (use --skip-disk-space-check to build anyway)",
+				ErrNotEnoughDiskSpace,
+				check.path,
+				units.BytesSize(float64(check.need)),
+				strings.Join(check.needed, ", "),
+				units.BytesSize(float64(check.available)),
+				units.BytesSize(float64(check.need-check.available)),
+			)
+		}
+	}
+
+	return estimate, nil
+}
+
+func statDiskSpace(path string) (*diskSpaceCheck, error) {
+	dev, available, err := statFilesystem(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskSpaceCheck{path: path, dev: dev, available: available}, nil
+}
+
+func (c *diskSpaceCheck) add(name string, size int64) {
+	if size == 0 {
+		return
+	}
+
+	c.need += size
+	c.needed = append(c.needed, units.BytesSize(float64(size))+" "+name)
+}
+
+// estimateDiskSpace resolves the manifests of all base images to estimate the disk space the build
+// needs. Layers the previous build extracted count with their real size, the size of all other
+// layers is estimated from their compressed size. The built layers and stage files are taken from
+// the previous build.
+func estimateDiskSpace(opts *config.KanikoOptions, images *baseImageResolver, persistPatterns []string) (*diskSpaceEstimate, error) {
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	if err != nil {
+		return nil, fmt.Errorf("parse dockerfile: %w", err)
+	}
+
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	if err != nil {
+		return nil, fmt.Errorf("resolve stages: %w", err)
+	}
+
+	previous, err := readDiskUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	// stages are extracted one after another, so / only needs space for the largest one. Stages
+	// that later stages build on are saved as tarball below /.dockerless.
+	estimate := &diskSpaceEstimate{}
+	extractedSizes := map[int]int64{}
+	compressedSizes := map[int]int64{}
+	var stageTarballs int64
+	for _, stage := range kanikoStages {
+		var extracted, compressed int64
+		if stage.BaseImageStoredLocally {
+			extracted = extractedSizes[stage.BaseImageIndex]
+			compressed = compressedSizes[stage.BaseImageIndex]
+		} else if stage.BaseName != constants.NoBaseImage {
+			image, err := images.stageImage(stage)
+			if err != nil {
+				return nil, fmt.Errorf("retrieve base image %s: %w", stage.BaseName, err)
+			}
+
+			layers, err := image.Layers()
+			if err != nil {
+				return nil, fmt.Errorf("get layers of base image %s: %w", stage.BaseName, err)
+			}
+			for _, layer := range layers {
+				layerSize, err := layer.Size()
+				if err != nil {
+					return nil, fmt.Errorf("get layer size of base image %s: %w", stage.BaseName, err)
+				}
+
+				compressed += layerSize
+				extracted += extractedLayerSize(layer, layerSize)
+			}
+
+			// a single stage resets / to the layers it shares with the previous build
+			if len(kanikoStages) == 1 {
+				estimate.Reused, err = reusedLayersSize(image, layers)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		extractedSizes[stage.Index] = extracted
+		compressedSizes[stage.Index] = compressed
+		if stage.SaveStage {
+			stageTarballs += compressed
+		}
+		if stage.Final {
+			estimate.FinalBase = extracted
+			extracted += previous.BuiltLayers
+		}
+		if extracted > estimate.RootFS {
+			estimate.RootFS = extracted
+		}
+	}
+	estimate.RootFS -= estimate.Reused
+
+	// kaniko writes a snapshot of every built layer below /.dockerless
+	estimate.Workspace = previous.BuiltLayers + max(stageTarballs, previous.StageFiles)
+
+	for _, pattern := range persistPatterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			size, err := diskUsage(match)
+			if err != nil {
+				return nil, fmt.Errorf("get size of %s: %w", match, err)
+			}
+
+			estimate.Persist += size
+		}
+	}
+
+	return estimate, nil
+}
+
+// extractedLayerSize returns the size of the files of a layer. It is read from the layer index if a
+// previous build extracted the layer, otherwise it is estimated from the compressed size.
+func extractedLayerSize(layer v1.Layer, compressedSize int64) int64 {
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return compressedSize * uncompressedSizeRatio
+	}
+
+	index, err := readLayerIndex(diffID)
+	if err != nil {
+		return compressedSize * uncompressedSizeRatio
+	}
+
+	return layerIndexSize(index)
+}
+
+// layerIndexSize returns the size of the regular files in a layer index
+func layerIndexSize(index []rootFSEntry) int64 {
+	var size int64
+	for _, entry := range index {
+		if entry.Type == tar.TypeReg {
+			size += entry.Size
+		}
+	}
+
+	return size
+}
+
+// reusedLayersSize returns the size of the base image layers that stay on /
+func reusedLayersSize(image v1.Image, layers []v1.Layer) (int64, error) {
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return 0, fmt.Errorf("get base image config: %w", err)
+	}
+
+	extracted, err := extractedLayers(configFile.RootFS.DiffIDs)
+	if err != nil || len(extracted.indexes) == 0 {
+		return 0, err
+	}
+
+	reuse, err := worthReusing(layers, len(extracted.indexes))
+	if err != nil || !reuse {
+		return 0, err
+	}
+
+	var size int64
+	for _, index := range extracted.indexes {
+		size += layerIndexSize(index)
+	}
+
+	return size, nil
+}
+
+// recordDiskUsage records the size of the built layers and the stage files of the build. The
+// built layers are what the final filesystem uses besides its base image and the persisted paths.
+func recordDiskUsage(estimate *diskSpaceEstimate) error {
+	dev, _, err := statFilesystem(config.RootDir)
+	if err != nil {
+		return fmt.Errorf("record disk usage: %w", err)
+	}
+
+	usage := &diskUsageRecord{
+		BuiltLayers: max(reclaimableSpace(dev)-estimate.FinalBase-estimate.Persist, 0),
+		StageFiles:  stageFilesUsage(),
+	}
+	out, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	err = writeStateFile(DiskUsageOutput, out)
+	if err != nil {
+		return fmt.Errorf("record disk usage: %w", err)
+	}
+
+	return nil
+}
+
+func readDiskUsage() (*diskUsageRecord, error) {
+	out, err := os.ReadFile(DiskUsageOutput)
+	if errors.Is(err, os.ErrNotExist) {
+		return &diskUsageRecord{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read disk usage: %w", err)
+	}
+
+	usage := &diskUsageRecord{}
+	err = json.Unmarshal(out, usage)
+	if err != nil {
+		return nil, fmt.Errorf("parse disk usage: %w", err)
+	}
+
+	return usage, nil
+}
+
+// stageFilesUsage returns the size of the stage tarballs and the files kaniko saved for COPY --from,
+// which kaniko keeps in /.dockerless/stages and /.dockerless/<stage index>
+func stageFilesUsage() int64 {
+	var size int64
+	if stagesSize, err := diskUsage(config.KanikoIntermediateStagesDir); err == nil {
+		size += stagesSize
+	}
+
+	files, _ := os.ReadDir(config.KanikoDir)
+	for _, file := range files {
+		if _, err := strconv.Atoi(file.Name()); err != nil || !file.IsDir() {
+			continue
+		}
+
+		dirSize, err := diskUsage(filepath.Join(config.KanikoDir, file.Name()))
+		if err == nil {
+			size += dirSize
+		}
+	}
+
+	return size
+}
+
+// statFilesystem returns the device and the free space of the filesystem path is on
+func statFilesystem(path string) (uint64, int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported file info")
+	}
+
+	statfs := &syscall.Statfs_t{}
+	err = syscall.Statfs(path, statfs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(stat.Dev), int64(statfs.Bavail) * int64(statfs.Bsize), nil
+}
+
+// reclaimableSpace returns the space on the given device that util.DeleteFilesystem frees
+func reclaimableSpace(dev uint64) int64 {
+	var size int64
+	seen := map[uint64]bool{}
+	_ = filepath.Walk(config.RootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil //nolint:nilerr
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if util.CheckCleanedPathAgainstIgnoreList(path) || !ok || uint64(stat.Dev) != dev {
+			if info.IsDir() && path != config.RootDir {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		// hard links only free their space once
+		if !info.IsDir() && stat.Nlink > 1 {
+			if seen[stat.Ino] {
+				return nil
+			}
+			seen[stat.Ino] = true
+		}
+
+		size += stat.Blocks * 512
+		return nil
+	})
+
+	return size
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestEstimateDiskSpace(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	image := strings.TrimPrefix(server.URL, "http://") + "/base:latest"
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseImage := testImage(t, map[string]string{"etc/hello": "world"})
+	err = remote.Write(ref, baseImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := baseImage.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := layers[0].Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID, err := layers[0].DiffID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		dockerfile string
+		previous   *diskUsageRecord
+		extracted  bool
+		want       diskSpaceEstimate
+	}{
+		{
+			name:       "single stage",
+			dockerfile: "FROM " + image + "\nRUN make\n",
+			want:       diskSpaceEstimate{RootFS: compressed * uncompressedSizeRatio, FinalBase: compressed * uncompressedSizeRatio},
+		},
+		{
+			name:       "built layers of the previous build",
+			dockerfile: "FROM " + image + "\nRUN make\n",
+			previous:   &diskUsageRecord{BuiltLayers: 1000},
+			want:       diskSpaceEstimate{RootFS: compressed*uncompressedSizeRatio + 1000, FinalBase: compressed * uncompressedSizeRatio, Workspace: 1000},
+		},
+		{
+			name:       "reused base image",
+			dockerfile: "FROM " + image + "\nRUN make\n",
+			previous:   &diskUsageRecord{BuiltLayers: 1000},
+			extracted:  true,
+			want:       diskSpaceEstimate{RootFS: 1000, Reused: 5, FinalBase: 5, Workspace: 1000},
+		},
+		{
+			name:       "multi stage",
+			dockerfile: "FROM " + image + " AS base\nRUN make\n\nFROM base AS dev\nRUN make install\n\nFROM scratch\nCOPY --from=dev /etc/hello /hello\n",
+			previous:   &diskUsageRecord{BuiltLayers: 10},
+			want:       diskSpaceEstimate{RootFS: compressed * uncompressedSizeRatio, Workspace: 10 + compressed},
+		},
+		{
+			name:       "stage files of the previous build",
+			dockerfile: "FROM " + image + " AS base\nRUN make\n\nFROM base AS dev\nRUN make install\n\nFROM scratch\nCOPY --from=dev /etc/hello /hello\n",
+			previous:   &diskUsageRecord{StageFiles: 1 << 20},
+			extracted:  true,
+			want:       diskSpaceEstimate{RootFS: 5, Workspace: 1 << 20},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			DiskUsageOutput = filepath.Join(dir, "disk-usage.json")
+			RootFSOutput = filepath.Join(dir, "rootfs.json")
+			RootFSIndexDir = filepath.Join(dir, "rootfs")
+			if test.previous != nil {
+				out, err := json.Marshal(test.previous)
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, DiskUsageOutput, string(out))
+			}
+			if test.extracted {
+				err := writeLayerIndex(diffID, []rootFSEntry{{Name: "etc", Type: tar.TypeDir}, {Name: "etc/hello", Type: tar.TypeReg, Size: 5}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, RootFSOutput, `{"layers": ["`+diffID.String()+`"]}`)
+			}
+
+			dockerfile := filepath.Join(dir, "Dockerfile")
+			writeFile(t, dockerfile, test.dockerfile)
+			cmd := &BuildCmd{}
+			cmd.InsecureRegistries = []string{ref.Context().RegistryStr()}
+			opts := &config.KanikoOptions{
+				DockerfilePath:   dockerfile,
+				SrcContext:       dir,
+				SkipUnusedStages: true,
+				RegistryOptions:  cmd.registryOptions(),
+			}
+
+			estimate, err := estimateDiskSpace(opts, newBaseImageResolver(opts, nil), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *estimate != test.want {
+				t.Fatalf("expected %+v, got %+v", test.want, *estimate)
+			}
+		})
+	}
+}
+
+func TestEstimateDiskSpacePersistedPaths(t *testing.T) {
+	dir := t.TempDir()
+	DiskUsageOutput = filepath.Join(dir, "disk-usage.json")
+	writeFile(t, filepath.Join(dir, "home", "dev", ".ssh", "id_rsa"), "key")
+	writeFile(t, filepath.Join(dir, "home", "ops", ".ssh", "id_rsa"), "other key")
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	writeFile(t, dockerfile, "FROM scratch\n")
+
+	opts := &config.KanikoOptions{DockerfilePath: dockerfile, SrcContext: dir}
+	estimate, err := estimateDiskSpace(opts, newBaseImageResolver(opts, nil), []string{filepath.Join(dir, "home", "*", ".ssh")})
+	if err != nil {
+		t.Fatal(err)
+	} else if estimate.Persist != int64(len("key")+len("other key")) {
+		t.Fatalf("expected the size of both keys, got %d", estimate.Persist)
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	setupDiskSpaceDirs(t)
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	writeFile(t, dockerfile, "FROM scratch\n")
+	opts := &config.KanikoOptions{DockerfilePath: dockerfile, SrcContext: filepath.Dir(dockerfile)}
+
+	_, err := (&BuildCmd{}).checkDiskSpace(opts, newBaseImageResolver(opts, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, DiskUsageOutput, `{"builtLayers": 1152921504606846976}`)
+	_, err = (&BuildCmd{}).checkDiskSpace(opts, newBaseImageResolver(opts, nil))
+	if !errors.Is(err, ErrNotEnoughDiskSpace) {
+		t.Fatalf("expected ErrNotEnoughDiskSpace, got %v", err)
+	} else if !strings.Contains(err.Error(), "needs an estimated") || !strings.Contains(err.Error(), "base images and built layers") {
+		t.Fatalf("expected the estimate in the error, got %v", err)
+	}
+}
+
+func TestRecordDiskUsage(t *testing.T) {
+	setupDiskSpaceDirs(t)
+	writeFile(t, filepath.Join(config.RootDir, "usr", "bin", "app"), strings.Repeat("x", 1<<16))
+	writeFile(t, filepath.Join(config.KanikoIntermediateStagesDir, "0"), strings.Repeat("x", 100))
+	writeFile(t, filepath.Join(config.KanikoDir, "1", "app"), strings.Repeat("x", 10))
+	writeFile(t, filepath.Join(config.KanikoDir, "cache", "layer"), strings.Repeat("x", 1000))
+
+	err := recordDiskUsage(&diskSpaceEstimate{FinalBase: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := readDiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.BuiltLayers < 1<<16-1<<10 {
+		t.Fatalf("expected the built layers without the base image, got %d", usage.BuiltLayers)
+	}
+	if usage.StageFiles != 110 {
+		t.Fatalf("expected stage tarballs and cross stage files, got %d", usage.StageFiles)
+	}
+}
+
+// setupDiskSpaceDirs points /, /.dockerless and the state files to temp dirs
+func setupDiskSpaceDirs(t *testing.T) {
+	t.Helper()
+
+	rootDir, kanikoDir, stagesDir := config.RootDir, config.KanikoDir, config.KanikoIntermediateStagesDir
+	t.Cleanup(func() {
+		config.RootDir, config.KanikoDir, config.KanikoIntermediateStagesDir = rootDir, kanikoDir, stagesDir
+	})
+
+	config.RootDir = t.TempDir()
+	config.KanikoDir = t.TempDir()
+	config.KanikoIntermediateStagesDir = filepath.Join(config.KanikoDir, "stages")
+	DiskUsageOutput = filepath.Join(config.KanikoDir, "disk-usage.json")
+	RootFSOutput = filepath.Join(config.KanikoDir, "rootfs.json")
+	RootFSIndexDir = filepath.Join(config.KanikoDir, "rootfs")
+}
@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CacheKeysOutput holds the cache keys of the previous build with --explain-cache, so the next one can tell what changed
+var CacheKeysOutput = "/.dockerless/cache-keys.json"
+
+// CacheReportOutput is written by builds with --explain-cache
+var CacheReportOutput = "/.dockerless/cache-report.json"
+
+// CacheResult tells if kaniko could reuse the layer of a command
+type CacheResult string
+
+const (
+	CacheHit     CacheResult = "hit"
+	CacheMiss    CacheResult = "miss"
+	CacheExpired CacheResult = "expired"
+	// CacheSkipped means kaniko did not look the command up, because an earlier command of the stage missed
+	CacheSkipped CacheResult = "skipped"
+	// CacheNotCached means the command only changes the image config and has no cached layer
+	CacheNotCached CacheResult = "not-cached"
+)
+
+var (
+	compositeKeyRegEx  = regexp.MustCompile(`^Optimize: composite key for command (.*?) \{\[(.*)\]\}$`)
+	cacheKeyRegEx      = regexp.MustCompile(`^Optimize: cache key for command (.*) ([0-9a-f]{64})$`)
+	checkingCacheRegEx = regexp.MustCompile(`^Checking for cached layer (.*)\.\.\.$`)
+	expiredCacheRegEx  = regexp.MustCompile(`^Cache entry expired: (.*)$`)
+	fileHashRegEx      = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	envCountRegEx      = regexp.MustCompile(`^\|(\d+)$`)
+	envNameRegEx       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+)
+
+// CacheKeyRecord are the cache keys of all commands of a build
+type CacheKeyRecord struct {
+	Stages []*StageCacheKeys `json:"stages"`
+}
+
+// StageCacheKeys are the cache keys of the commands of a single stage
+type StageCacheKeys struct {
+	Name     string              `json:"name"`
+	Index    int                 `json:"index"`
+	Commands []*CommandCacheKeys `json:"commands"`
+}
+
+// CommandCacheKeys are the components kaniko has hashed into the cache key of a command. Env and
+// build arg values are only recorded as hashes, as they might contain secrets.
+type CommandCacheKeys struct {
+	Command     string            `json:"command"`
+	CacheKey    string            `json:"cacheKey"`
+	Base        string            `json:"base"`
+	ParentKey   string            `json:"parentKey,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	CommandHash string            `json:"commandHash"`
+	Files       []string          `json:"files,omitempty"`
+	Result      CacheResult       `json:"result"`
+	Source      string            `json:"source,omitempty"`
+	Changed     []string          `json:"changed,omitempty"`
+
+	keyComponents string
+}
+
+// cacheExplainer is a logrus hook that collects the cache keys kaniko logs at debug level
+type cacheExplainer struct {
+	m       sync.Mutex
+	record  CacheKeyRecord
+	stopped bool
+
+	previousLevel     logrus.Level
+	previousFormatter logrus.Formatter
+}
+
+// startCacheExplainer makes kaniko log its cache keys, without printing debug messages
+func startCacheExplainer() *cacheExplainer {
+	logger := logrus.StandardLogger()
+	explainer := &cacheExplainer{
+		previousLevel:     logger.GetLevel(),
+		previousFormatter: logger.Formatter,
+	}
+	if explainer.previousLevel < logrus.DebugLevel {
+		logger.SetFormatter(&levelFormatter{Formatter: logger.Formatter, level: explainer.previousLevel})
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	logger.AddHook(explainer)
+	return explainer
+}
+
+// stop restores the previous log level and returns the collected cache keys
+func (e *cacheExplainer) stop() *CacheKeyRecord {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if !e.stopped {
+		e.stopped = true
+		logrus.SetLevel(e.previousLevel)
+		logrus.SetFormatter(e.previousFormatter)
+	}
+
+	return &e.record
+}
+
+func (e *cacheExplainer) Levels() []logrus.Level {
+	return []logrus.Level{logrus.InfoLevel, logrus.DebugLevel}
+}
+
+func (e *cacheExplainer) Fire(entry *logrus.Entry) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.stopped {
+		return nil
+	}
+
+	message := entry.Message
+	if matches := buildingStageRegEx.FindStringSubmatch(message); len(matches) == 3 {
+		index, _ := strconv.Atoi(matches[2])
+		e.record.Stages = append(e.record.Stages, &StageCacheKeys{Name: matches[1], Index: index})
+	} else if matches := compositeKeyRegEx.FindStringSubmatch(message); len(matches) == 3 {
+		e.addCommand(matches[1], matches[2])
+	} else if command := e.lastCommand(); command == nil {
+		return nil
+	} else if matches := cacheKeyRegEx.FindStringSubmatch(message); len(matches) == 3 {
+		command.CacheKey = matches[2]
+	} else if matches := checkingCacheRegEx.FindStringSubmatch(message); len(matches) == 2 {
+		command.Source = "registry"
+		if strings.HasPrefix(matches[1], ociCachePrefix) {
+			command.Source = "local"
+		}
+	} else if expiredCacheRegEx.MatchString(message) {
+		command.Result = CacheExpired
+	} else if message == "No cached layer found for cmd "+command.Command && command.Result != CacheExpired {
+		command.Result = CacheMiss
+	} else if message == "Using caching version of cmd: "+command.Command {
+		command.Result = CacheHit
+	}
+
+	return nil
+}
+
+// addCommand splits the composite key of a command into its components. kaniko adds the components
+// of every command to the composite key of the previous command, starting with the base image digest.
+func (e *cacheExplainer) addCommand(command, keyComponents string) {
+	if len(e.record.Stages) == 0 {
+		return
+	}
+	stage := e.record.Stages[len(e.record.Stages)-1]
+
+	keys := &CommandCacheKeys{Command: command, keyComponents: keyComponents}
+	components := ""
+	if len(stage.Commands) > 0 {
+		parent := stage.Commands[len(stage.Commands)-1]
+		keys.Base = parent.Base
+		keys.ParentKey = parent.CacheKey
+		components = strings.TrimPrefix(keyComponents, parent.keyComponents+" ")
+	} else {
+		keys.Base, components, _ = strings.Cut(keyComponents, " ")
+	}
+
+	tokens := strings.Split(components, " ")
+	keyword, _, _ := strings.Cut(command, " ")
+
+	// build args and env are prefixed with |<count>
+	if matches := envCountRegEx.FindStringSubmatch(tokens[0]); len(matches) == 2 {
+		count, _ := strconv.Atoi(matches[1])
+		env := []string{}
+		i := 1
+		for ; i < len(tokens); i++ {
+			if len(env) < count && envNameRegEx.MatchString(tokens[i]) {
+				env = append(env, tokens[i])
+			} else if len(env) == count && tokens[i] == keyword {
+				break
+			} else if len(env) > 0 {
+				env[len(env)-1] += " " + tokens[i]
+			}
+		}
+
+		keys.Env = map[string]string{}
+		for _, envVar := range env {
+			name, value, _ := strings.Cut(envVar, "=")
+			keys.Env[name] = hashString(value)
+		}
+		tokens = tokens[i:]
+	}
+
+	// the hashes of the files used from the context come last
+	for len(tokens) > 1 && fileHashRegEx.MatchString(tokens[len(tokens)-1]) {
+		keys.Files = append([]string{tokens[len(tokens)-1]}, keys.Files...)
+		tokens = tokens[:len(tokens)-1]
+	}
+	keys.CommandHash = hashString(strings.Join(tokens, " "))
+
+	// kaniko stops looking up commands after the first miss
+	keys.Result = CacheNotCached
+	for _, previous := range stage.Commands {
+		if previous.Result == CacheMiss || previous.Result == CacheExpired {
+			keys.Result = CacheSkipped
+		}
+	}
+
+	stage.Commands = append(stage.Commands, keys)
+}
+
+func (e *cacheExplainer) lastCommand() *CommandCacheKeys {
+	if len(e.record.Stages) == 0 {
+		return nil
+	}
+
+	stage := e.record.Stages[len(e.record.Stages)-1]
+	if len(stage.Commands) == 0 {
+		return nil
+	}
+
+	return stage.Commands[len(stage.Commands)-1]
+}
+
+// explainChanges sets which components of each command changed compared to the previous build
+func explainChanges(record, previous *CacheKeyRecord) {
+	previousStages := map[int]*StageCacheKeys{}
+	if previous != nil {
+		for _, stage := range previous.Stages {
+			previousStages[stage.Index] = stage
+		}
+	}
+
+	for _, stage := range record.Stages {
+		previousStage := previousStages[stage.Index]
+		for i, command := range stage.Commands {
+			if previousStage == nil || i >= len(previousStage.Commands) {
+				command.Changed = []string{"new command"}
+				continue
+			}
+
+			command.Changed = compareCacheKeys(command, previousStage.Commands[i])
+		}
+	}
+}
+
+func compareCacheKeys(command, previous *CommandCacheKeys) []string {
+	if command.CacheKey == previous.CacheKey {
+		return nil
+	}
+
+	changed := []string{}
+	if command.Base != previous.Base {
+		changed = append(changed, "base image")
+	} else if command.ParentKey != previous.ParentKey {
+		changed = append(changed, "earlier command")
+	}
+	if command.CommandHash != previous.CommandHash {
+		changed = append(changed, "command")
+	}
+	for _, name := range changedEnv(command.Env, previous.Env) {
+		changed = append(changed, "env "+name)
+	}
+	if strings.Join(command.Files, " ") != strings.Join(previous.Files, " ") {
+		changed = append(changed, "context files")
+	}
+
+	return changed
+}
+
+// changedEnv returns the names of all variables that were added, removed or changed
+func changedEnv(env, previous map[string]string) []string {
+	names := []string{}
+	for name, value := range env {
+		if previousValue, ok := previous[name]; !ok || previousValue != value {
+			names = append(names, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := env[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// readCacheKeys reads the cache keys of the previous build, it returns nil if there was none
+func readCacheKeys() *CacheKeyRecord {
+	out, err := os.ReadFile(CacheKeysOutput)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("warning: read previous cache keys: %v\n", err)
+		}
+
+		return nil
+	}
+
+	record := &CacheKeyRecord{}
+	err = json.Unmarshal(out, record)
+	if err != nil {
+		fmt.Printf("warning: parse previous cache keys: %v\n", err)
+		return nil
+	}
+
+	return record
+}
+
+// writeCacheKeys records the cache keys of this build and writes and prints the report
+func writeCacheKeys(record *CacheKeyRecord) error {
+	previous := readCacheKeys()
+
+	out, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal cache keys: %w", err)
+	}
+
+	err = writeStateFile(CacheKeysOutput, out)
+	if err != nil {
+		return fmt.Errorf("write cache keys: %w", err)
+	}
+
+	explainChanges(record, previous)
+	out, err = json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal cache report: %w", err)
+	}
+
+	err = writeStateFile(CacheReportOutput, out)
+	if err != nil {
+		return fmt.Errorf("write cache report: %w", err)
+	}
+
+	return printCacheReport(record, previous != nil)
+}
+
+// removeCacheKeys removes the cache keys of an earlier build, as the next build with --explain-cache
+// would otherwise compare its keys with them instead of the keys of the build before it
+func removeCacheKeys() {
+	err := os.Remove(CacheKeysOutput)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("warning: remove previous cache keys: %v\n", err)
+	}
+}
+
+func printCacheReport(record *CacheKeyRecord, hasPrevious bool) error {
+	fmt.Printf("cache report (written to %s):\n", CacheReportOutput)
+	if !hasPrevious {
+		fmt.Println("no cache keys of a previous build were recorded, so changes cannot be explained")
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "STAGE\tRESULT\tCOMMAND\tCHANGED")
+	for _, stage := range record.Stages {
+		for _, command := range stage.Commands {
+			result := string(command.Result)
+			if command.Result == CacheHit && command.Source != "" {
+				result += " (" + command.Source + ")"
+			}
+
+			_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n",
+				fmt.Sprintf("%s (index %d)", stage.Name, stage.Index),
+				result,
+				command.Command,
+				strings.Join(command.Changed, ", "),
+			)
+		}
+	}
+
+	return writer.Flush()
+}
+
+// levelFormatter drops entries above level, so we can collect debug entries without printing them
+type levelFormatter struct {
+	logrus.Formatter
+	level logrus.Level
+}
+
+func (f *levelFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level > f.level {
+		return nil, nil
+	}
+
+	return f.Formatter.Format(entry)
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCacheExplainer(t *testing.T) {
+	fileHash := strings.Repeat("f", 64)
+	copyKey := strings.Repeat("b", 64)
+	explainer := &cacheExplainer{}
+	for _, message := range []string{
+		"Building stage 'ubuntu' [idx: '0', base-idx: '-1']",
+		"Optimize: composite key for command RUN echo hi {[sha256:base RUN echo hi]}",
+		"Optimize: cache key for command RUN echo hi " + strings.Repeat("a", 64),
+		"Checking for cached layer oci:/.dockerless/layers/layer:" + strings.Repeat("a", 64) + "...",
+		"Using caching version of cmd: RUN echo hi",
+		"Optimize: composite key for command COPY . /app {[sha256:base RUN echo hi COPY . /app " + fileHash + "]}",
+		"Optimize: cache key for command COPY . /app " + copyKey,
+		"Checking for cached layer my.registry/cache:" + copyKey + "...",
+		"No cached layer found for cmd COPY . /app",
+		"Optimize: composite key for command RUN make {[sha256:base RUN echo hi COPY . /app " + fileHash + " |1 VERSION=1 2 RUN make]}",
+	} {
+		_ = explainer.Fire(&logrus.Entry{Message: message})
+	}
+
+	record := explainer.record
+	if len(record.Stages) != 1 || len(record.Stages[0].Commands) != 3 {
+		t.Fatalf("expected a stage with 3 commands, got %+v", record.Stages)
+	}
+
+	commands := record.Stages[0].Commands
+	want := []CommandCacheKeys{
+		{Command: "RUN echo hi", CacheKey: strings.Repeat("a", 64), Base: "sha256:base", CommandHash: hashString("RUN echo hi"), Result: CacheHit, Source: "local"},
+		{Command: "COPY . /app", CacheKey: copyKey, Base: "sha256:base", ParentKey: strings.Repeat("a", 64), CommandHash: hashString("COPY . /app"), Files: []string{fileHash}, Result: CacheMiss, Source: "registry"},
+		{Command: "RUN make", Base: "sha256:base", ParentKey: copyKey, Env: map[string]string{"VERSION": hashString("1 2")}, CommandHash: hashString("RUN make"), Result: CacheSkipped},
+	}
+	for i, command := range commands {
+		got := *command
+		got.keyComponents = ""
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("command %d: expected %+v, got %+v", i, want[i], got)
+		}
+	}
+}
+
+func TestStartCacheExplainer(t *testing.T) {
+	logrus.SetLevel(logrus.InfoLevel)
+	formatter := logrus.StandardLogger().Formatter
+
+	explainer := startCacheExplainer()
+	if logrus.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("expected debug level while explaining, got %s", logrus.GetLevel())
+	}
+
+	// debug entries are collected, but not printed
+	out, err := logrus.StandardLogger().Formatter.Format(&logrus.Entry{Level: logrus.DebugLevel, Message: "debug"})
+	if err != nil || len(out) > 0 {
+		t.Fatalf("expected debug entries to be dropped, got %q, %v", out, err)
+	}
+
+	explainer.stop()
+	if logrus.GetLevel() != logrus.InfoLevel || logrus.StandardLogger().Formatter != formatter {
+		t.Fatalf("expected log level and formatter to be restored, got %s", logrus.GetLevel())
+	}
+}
+
+func TestCompareCacheKeys(t *testing.T) {
+	previous := &CommandCacheKeys{
+		CacheKey:    "key",
+		Base:        "sha256:base",
+		ParentKey:   "parent",
+		Env:         map[string]string{"A": "1", "B": "2"},
+		CommandHash: "command",
+		Files:       []string{"file"},
+	}
+
+	tests := []struct {
+		name   string
+		change func(keys *CommandCacheKeys)
+		want   []string
+	}{
+		{name: "unchanged", change: func(keys *CommandCacheKeys) {}},
+		{name: "base image", change: func(keys *CommandCacheKeys) { keys.Base, keys.ParentKey = "sha256:new", "new" }, want: []string{"base image"}},
+		{name: "earlier command", change: func(keys *CommandCacheKeys) { keys.ParentKey = "new" }, want: []string{"earlier command"}},
+		{name: "command", change: func(keys *CommandCacheKeys) { keys.CommandHash = "new" }, want: []string{"command"}},
+		{name: "env", change: func(keys *CommandCacheKeys) { keys.Env = map[string]string{"A": "new", "C": "3"} }, want: []string{"env A", "env B", "env C"}},
+		{name: "context files", change: func(keys *CommandCacheKeys) { keys.Files = []string{"new"} }, want: []string{"context files"}},
+	}
+	for _, test := range tests {
+		keys := *previous
+		test.change(&keys)
+		if !reflect.DeepEqual(keys, *previous) {
+			keys.CacheKey = "changed"
+		}
+
+		got := compareCacheKeys(&keys, previous)
+		if len(got) == 0 && len(test.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestWriteCacheKeys(t *testing.T) {
+	dir := t.TempDir()
+	CacheKeysOutput = filepath.Join(dir, "cache-keys.json")
+	CacheReportOutput = filepath.Join(dir, "cache-report.json")
+
+	record := func(commandHash string) *CacheKeyRecord {
+		return &CacheKeyRecord{Stages: []*StageCacheKeys{{Name: "ubuntu", Commands: []*CommandCacheKeys{
+			{Command: "RUN make", CacheKey: commandHash, Base: "sha256:base", CommandHash: commandHash},
+		}}}}
+	}
+
+	first := record("first")
+	err := writeCacheKeys(first)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(first.Stages[0].Commands[0].Changed, []string{"new command"}) {
+		t.Fatalf("expected new command, got %v", first.Stages[0].Commands[0].Changed)
+	}
+
+	second := record("second")
+	err = writeCacheKeys(second)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(second.Stages[0].Commands[0].Changed, []string{"command"}) {
+		t.Fatalf("expected changed command, got %v", second.Stages[0].Commands[0].Changed)
+	}
+
+	// builds without --explain-cache remove the keys, so they are not compared with a later build
+	removeCacheKeys()
+	if fileExists(CacheKeysOutput) {
+		t.Fatal("expected cache keys to be removed")
+	}
+	removeCacheKeys()
+}
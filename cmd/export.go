@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// defaultImageName is used to tag exported images if no other name is known
+const defaultImageName = "dockerless:latest"
+
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// exportOCILayout writes the complete image as an OCI image layout to path
+func exportOCILayout(image v1.Image, path string, imageNames []string) error {
+	if len(imageNames) == 0 {
+		imageNames = []string{defaultImageName}
+	}
+
+	// always start with an empty index, so the layout only contains the image we built
+	layoutPath, err := layout.Write(path, empty.Index)
+	if err != nil {
+		return fmt.Errorf("write empty layout: %w", err)
+	}
+
+	for _, imageName := range imageNames {
+		err = layoutPath.AppendImage(image, layout.WithAnnotations(map[string]string{
+			ociRefNameAnnotation: imageName,
+		}))
+		if err != nil {
+			return fmt.Errorf("append image %s to layout: %w", imageName, err)
+		}
+	}
+
+	return nil
+}
+
+// exportTarball writes the complete image as a docker tarball to path, which can be loaded via docker load
+func exportTarball(image v1.Image, path string, imageNames []string) error {
+	if len(imageNames) == 0 {
+		imageNames = []string{defaultImageName}
+	}
+
+	refToImage := map[name.Reference]v1.Image{}
+	for _, imageName := range imageNames {
+		ref, err := name.ParseReference(imageName, name.WeakValidation)
+		if err != nil {
+			return fmt.Errorf("parse image name %s: %w", imageName, err)
+		}
+
+		refToImage[ref] = image
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("create tarball dir: %w", err)
+	}
+
+	err = tarball.MultiRefWriteToFile(path, refToImage)
+	if err != nil {
+		return fmt.Errorf("write tarball: %w", err)
+	}
+
+	return nil
+}
+
+// exportImage writes the image to all configured outputs
+func (cmd *BuildCmd) exportImage(image v1.Image) error {
+	if cmd.OCILayoutPath != "" {
+		fmt.Printf("exporting image as oci layout to %s\n", cmd.OCILayoutPath)
+		err := exportOCILayout(image, cmd.OCILayoutPath, cmd.Destinations)
+		if err != nil {
+			return fmt.Errorf("export oci layout: %w", err)
+		}
+	}
+
+	if cmd.TarPath != "" {
+		fmt.Printf("exporting image as tarball to %s\n", cmd.TarPath)
+		err := exportTarball(image, cmd.TarPath, cmd.Destinations)
+		if err != nil {
+			return fmt.Errorf("export tarball: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// outputs lists where the image is exported and pushed to. They are part of the fingerprint, as
+// we need to rebuild the image to write it somewhere else.
+func (cmd *BuildCmd) outputs() []string {
+	outputs := []string{}
+	if cmd.OCILayoutPath != "" {
+		outputs = append(outputs, "oci-layout="+cmd.OCILayoutPath)
+	}
+	if cmd.TarPath != "" {
+		outputs = append(outputs, "tar="+cmd.TarPath)
+	}
+	for _, destination := range cmd.Destinations {
+		outputs = append(outputs, "destination="+destination)
+	}
+	if cmd.DigestFile != "" {
+		outputs = append(outputs, "digest-file="+cmd.DigestFile)
+	}
+	if cmd.ImageNameTagDigestFile != "" {
+		outputs = append(outputs, "image-name-tag-with-digest-file="+cmd.ImageNameTagDigestFile)
+	}
+
+	return outputs
+}
+
+// outputsExist returns true if the outputs of the previous build are still there
+func (cmd *BuildCmd) outputsExist() bool {
+	paths := []string{}
+	if cmd.OCILayoutPath != "" {
+		paths = append(paths, filepath.Join(cmd.OCILayoutPath, "index.json"))
+	}
+	if cmd.TarPath != "" {
+		paths = append(paths, cmd.TarPath)
+	}
+	if cmd.DigestFile != "" {
+		paths = append(paths, cmd.DigestFile)
+	}
+	if cmd.ImageNameTagDigestFile != "" {
+		paths = append(paths, cmd.ImageNameTagDigestFile)
+	}
+
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if err != nil {
+			fmt.Printf("rebuilding image, because output %s is missing\n", path)
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestExportImage(t *testing.T) {
+	dir := t.TempDir()
+	image := testImage(t, map[string]string{"etc/hello": "world"})
+	cmd := &BuildCmd{
+		OCILayoutPath: filepath.Join(dir, "layout"),
+		TarPath:       filepath.Join(dir, "out", "image.tar"),
+		Destinations:  []string{"registry.example.com/app:v1"},
+	}
+	if cmd.outputsExist() {
+		t.Fatal("expected outputs to be missing before the export")
+	}
+
+	err := cmd.exportImage(image)
+	if err != nil {
+		t.Fatal(err)
+	} else if !cmd.outputsExist() {
+		t.Fatal("expected outputs to exist after the export")
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layoutPath, err := layout.FromPath(cmd.OCILayoutPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := layoutPath.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(manifest.Manifests) != 1 || manifest.Manifests[0].Digest != digest {
+		t.Fatalf("expected layout with image %s, got %+v", digest, manifest.Manifests)
+	} else if name := manifest.Manifests[0].Annotations[ociRefNameAnnotation]; name != cmd.Destinations[0] {
+		t.Fatalf("expected ref name %s, got %s", cmd.Destinations[0], name)
+	}
+
+	loaded, err := tarball.ImageFromPath(cmd.TarPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedDigest, err := loaded.Digest()
+	if err != nil {
+		t.Fatal(err)
+	} else if loadedDigest != digest {
+		t.Fatalf("expected tarball image %s, got %s", digest, loadedDigest)
+	}
+}
+
+// testImage returns an image with a single layer that contains files
+func testImage(t *testing.T, files map[string]string) v1.Image {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(buf)
+	for name, content := range files {
+		err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tarWriter.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return image
+}
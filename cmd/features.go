@@ -0,0 +1,629 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// FeaturesDir is where the devcontainer Features are staged for the build. It is excluded from
+// deletion and snapshots, so the Feature files do not end up in the image.
+var FeaturesDir = "/.dockerless/features"
+
+const (
+	featureTargetStage        = "dockerless-target"
+	featureStagePrefix        = "dockerless-feature-"
+	featureEnvFile            = "devcontainer-features.env"
+	devContainerMetadataLabel = "devcontainer.metadata"
+)
+
+var (
+	featureIDRegEx           = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	featureOptionCharsRegEx  = regexp.MustCompile(`[^\w_]`)
+	featureOptionPrefixRegEx = regexp.MustCompile(`^[\d_]+`)
+)
+
+// userHomeScript looks up the home of a user in /etc/passwd, as getent is not available in every image
+const userHomeScript = `$(while IFS=: read -r name _ uid _ _ home _; do if [ "$name" = "%[1]s" ] || [ "$uid" = "%[1]s" ]; then echo "$home"; break; fi; done < /etc/passwd)`
+
+// DevContainerFeature is the devcontainer-feature.json of a local Feature
+type DevContainerFeature struct {
+	ID            string                   `json:"id"`
+	Version       string                   `json:"version,omitempty"`
+	Name          string                   `json:"name,omitempty"`
+	Options       map[string]FeatureOption `json:"options,omitempty"`
+	InstallsAfter []string                 `json:"installsAfter,omitempty"`
+	ContainerEnv  map[string]string        `json:"containerEnv,omitempty"`
+	Entrypoint    string                   `json:"entrypoint,omitempty"`
+	CapAdd        []string                 `json:"capAdd,omitempty"`
+	SecurityOpt   []string                 `json:"securityOpt,omitempty"`
+	Privileged    *bool                    `json:"privileged,omitempty"`
+	Init          *bool                    `json:"init,omitempty"`
+
+	// dir is the absolute path of the Feature folder and options are the values it is installed with
+	dir     string
+	options map[string]string
+}
+
+// FeatureOption is an option declared by a Feature
+type FeatureOption struct {
+	Type    string      `json:"type,omitempty"`
+	Default interface{} `json:"default,omitempty"`
+}
+
+// featureMetadata is the entry of a Feature in the devcontainer.metadata label, which tools read
+// to create the container with the capabilities and entrypoints the Feature needs
+type featureMetadata struct {
+	ID           string            `json:"id"`
+	ContainerEnv map[string]string `json:"containerEnv,omitempty"`
+	Entrypoint   string            `json:"entrypoint,omitempty"`
+	CapAdd       []string          `json:"capAdd,omitempty"`
+	SecurityOpt  []string          `json:"securityOpt,omitempty"`
+	Privileged   *bool             `json:"privileged,omitempty"`
+	Init         *bool             `json:"init,omitempty"`
+}
+
+// featureRef references a local Feature folder and the options to install it with
+type featureRef struct {
+	Path    string
+	Options map[string]string
+}
+
+// stagedFeature is a Feature together with the folder it is installed from during the build
+type stagedFeature struct {
+	feature *DevContainerFeature
+	envFile []byte
+	dir     string
+}
+
+// parseFeatureFlag parses a Feature of the form path[,option=value...]
+func parseFeatureFlag(value string) (featureRef, error) {
+	parts := strings.Split(value, ",")
+	ref := featureRef{Path: parts[0], Options: map[string]string{}}
+	if ref.Path == "" {
+		return ref, fmt.Errorf("invalid --feature %s: expected path[,option=value...]", value)
+	}
+
+	for _, option := range parts[1:] {
+		name, optionValue, ok := strings.Cut(option, "=")
+		if !ok || name == "" {
+			return ref, fmt.Errorf("invalid --feature %s: expected path[,option=value...]", value)
+		}
+
+		ref.Options[name] = optionValue
+	}
+
+	return ref, nil
+}
+
+// featureRefs returns the local Features of the devcontainer.json, which are resolved relative to it.
+// Features from a registry are skipped, as they cannot be installed without network access.
+func (c *DevContainerConfig) featureRefs() []featureRef {
+	ids := make([]string, 0, len(c.Features))
+	for id := range c.Features {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	refs := []featureRef{}
+	for _, id := range ids {
+		if !strings.HasPrefix(id, "./") && !strings.HasPrefix(id, "../") && !filepath.IsAbs(id) {
+			fmt.Printf("warning: skipping feature %s of %s, only local Features are supported\n", id, c.path)
+			continue
+		}
+
+		options := map[string]string{}
+		switch value := c.Features[id].(type) {
+		case map[string]interface{}:
+			for name, optionValue := range value {
+				options[name] = featureOptionString(optionValue)
+			}
+		case string:
+			options["version"] = value
+		case bool:
+			if !value {
+				continue
+			}
+		}
+
+		refs = append(refs, featureRef{Path: resolvePath(filepath.Dir(c.path), id), Options: options})
+	}
+
+	return refs
+}
+
+// resolveFeatures reads the Features of the devcontainer.json, DOCKERLESS_FEATURES and the flags in
+// the order they have to be installed. Options of a Feature that is referenced multiple times are merged.
+func (cmd *BuildCmd) resolveFeatures() ([]*DevContainerFeature, error) {
+	refs := []featureRef{}
+	installOrder := []string{}
+	if cmd.devContainer != nil {
+		refs = append(refs, cmd.devContainer.featureRefs()...)
+		installOrder = cmd.devContainer.OverrideFeatureInstallOrder
+	}
+
+	envFeatures, err := jsonListFromEnv("DOCKERLESS_FEATURES")
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range append(envFeatures, cmd.Features...) {
+		ref, err := parseFeatureFlag(value)
+		if err != nil {
+			return nil, err
+		}
+
+		refs = append(refs, ref)
+	}
+
+	features := []*DevContainerFeature{}
+	featuresByDir := map[string]*DevContainerFeature{}
+	for _, ref := range refs {
+		dir, err := filepath.Abs(ref.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		feature, ok := featuresByDir[dir]
+		if !ok {
+			feature, err = readFeature(dir)
+			if err != nil {
+				return nil, err
+			}
+
+			featuresByDir[dir] = feature
+			features = append(features, feature)
+		}
+		for name, value := range ref.Options {
+			feature.options[name] = value
+		}
+	}
+
+	return sortFeatures(features, installOrder), nil
+}
+
+// readFeature reads the devcontainer-feature.json of a local Feature folder
+func readFeature(dir string) (*DevContainerFeature, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "devcontainer-feature.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read feature: %w", err)
+	}
+
+	feature := &DevContainerFeature{dir: dir, options: map[string]string{}}
+	err = json.Unmarshal(stripJSONComments(content), feature)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filepath.Join(dir, "devcontainer-feature.json"), err)
+	} else if !featureIDRegEx.MatchString(feature.ID) {
+		return nil, fmt.Errorf("feature %s has an invalid id %q", dir, feature.ID)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "install.sh"))
+	if err != nil {
+		return nil, fmt.Errorf("feature %s: %w", feature.ID, err)
+	}
+
+	return feature, nil
+}
+
+// sortFeatures orders the Features listed in installOrder first and installs every Feature after
+// the Features of its installsAfter. installsAfter is only a soft dependency, so cycles are ignored.
+func sortFeatures(features []*DevContainerFeature, installOrder []string) []*DevContainerFeature {
+	priority := func(feature *DevContainerFeature) int {
+		for i, ref := range installOrder {
+			if featureIDFromRef(ref) == feature.ID || featureIDFromRef(ref) == filepath.Base(feature.dir) {
+				return i
+			}
+		}
+
+		return len(installOrder)
+	}
+	sort.SliceStable(features, func(i, j int) bool {
+		return priority(features[i]) < priority(features[j])
+	})
+
+	sorted := []*DevContainerFeature{}
+	pending := features
+	for len(pending) > 0 {
+		next := 0
+		for i, feature := range pending {
+			if !waitsForFeature(feature, pending) {
+				next = i
+				break
+			}
+		}
+
+		sorted = append(sorted, pending[next])
+		pending = append(pending[:next:next], pending[next+1:]...)
+	}
+
+	return sorted
+}
+
+// waitsForFeature returns true if feature has to be installed after one of the pending Features
+func waitsForFeature(feature *DevContainerFeature, pending []*DevContainerFeature) bool {
+	for _, ref := range feature.InstallsAfter {
+		for _, other := range pending {
+			if other != feature && featureIDFromRef(ref) == other.ID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// featureIDFromRef returns the id of a Feature reference such as ghcr.io/devcontainers/features/go:1 or ./go
+func featureIDFromRef(ref string) string {
+	ref, _, _ = strings.Cut(ref, "@")
+	id, _, _ := strings.Cut(path.Base(ref), ":")
+	return id
+}
+
+func featureOptionString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// featureOptionEnv returns the name of the env variable an option is passed to install.sh with
+func featureOptionEnv(name string) string {
+	name = featureOptionCharsRegEx.ReplaceAllString(name, "_")
+	return strings.ToUpper(featureOptionPrefixRegEx.ReplaceAllString(name, "_"))
+}
+
+// envFile returns the env file install.sh is run with. It contains the options, falling back to
+// their defaults, and the users the container is created and used with.
+func (f *DevContainerFeature) envFile(containerUser, remoteUser string) []byte {
+	names := make([]string, 0, len(f.options))
+	for name := range f.options {
+		if _, ok := f.Options[name]; !ok {
+			fmt.Printf("warning: feature %s does not declare option %s\n", f.ID, name)
+		}
+
+		names = append(names, name)
+	}
+	for name, option := range f.Options {
+		if _, ok := f.options[name]; !ok && option.Default != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := &bytes.Buffer{}
+	for _, name := range names {
+		value, ok := f.options[name]
+		if !ok {
+			value = featureOptionString(f.Options[name].Default)
+		}
+
+		fmt.Fprintf(out, "%s=%s\n", featureOptionEnv(name), shellQuote(value))
+	}
+	fmt.Fprintf(out, "_CONTAINER_USER=%s\n", shellQuote(containerUser))
+	fmt.Fprintf(out, "_REMOTE_USER=%s\n", shellQuote(remoteUser))
+	fmt.Fprintf(out, "_CONTAINER_USER_HOME=\"%s\"\n", fmt.Sprintf(userHomeScript, "$_CONTAINER_USER"))
+	fmt.Fprintf(out, "_REMOTE_USER_HOME=\"%s\"\n", fmt.Sprintf(userHomeScript, "$_REMOTE_USER"))
+
+	return out.Bytes()
+}
+
+// stage returns the Feature with the folder it is staged in. The folder name contains a hash of
+// the Feature files and options, so changing them invalidates the cached layer of install.sh.
+func (f *DevContainerFeature) stage(containerUser, remoteUser string) (stagedFeature, error) {
+	staged := stagedFeature{feature: f, envFile: f.envFile(containerUser, remoteUser)}
+
+	hash := sha256.New()
+	err := filepath.WalkDir(f.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(f.dir, path)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(relPath))
+		_, err = io.Copy(hash, file)
+		return err
+	})
+	if err != nil {
+		return staged, fmt.Errorf("hash feature %s: %w", f.ID, err)
+	}
+	hash.Write(staged.envFile)
+
+	staged.dir = filepath.Join(FeaturesDir, fmt.Sprintf("%s-%x", f.ID, hash.Sum(nil)[:6]))
+	return staged, nil
+}
+
+// stageFeatures copies the Feature folders to FeaturesDir, which survives the deletion of the filesystem
+func stageFeatures(staged []stagedFeature) error {
+	err := os.RemoveAll(FeaturesDir)
+	if err != nil {
+		return fmt.Errorf("remove staged features: %w", err)
+	}
+
+	for _, s := range staged {
+		err = copyDir(s.feature.dir, s.dir)
+		if err != nil {
+			return fmt.Errorf("stage feature %s: %w", s.feature.ID, err)
+		}
+
+		// install.sh and the scripts it calls have to be executable
+		err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			return os.Chmod(path, 0755)
+		})
+		if err != nil {
+			return fmt.Errorf("stage feature %s: %w", s.feature.ID, err)
+		}
+
+		err = os.WriteFile(filepath.Join(s.dir, featureEnvFile), s.envFile, 0644)
+		if err != nil {
+			return fmt.Errorf("stage feature %s: %w", s.feature.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// applyFeatures generates a Dockerfile that installs the Features in extra stages on top of the
+// target and points opts to it. The Features are only staged if we actually build. The folder of
+// the generated Dockerfile has to be removed after the build.
+func (cmd *BuildCmd) applyFeatures(opts *config.KanikoOptions, images *baseImageResolver, features []*DevContainerFeature) error {
+	if strings.HasPrefix(opts.DockerfilePath, "http://") || strings.HasPrefix(opts.DockerfilePath, "https://") {
+		return fmt.Errorf("devcontainer Features require a local Dockerfile")
+	}
+
+	// we need the config of the target to know its user, entrypoint and metadata
+	plan, err := planBuild(opts, images)
+	if err != nil {
+		return err
+	}
+	target := ""
+	for _, stage := range plan.Stages {
+		if stage.Final {
+			target = stage.Name
+		}
+	}
+
+	content, err := os.ReadFile(opts.DockerfilePath)
+	if err != nil {
+		return fmt.Errorf("read dockerfile: %w", err)
+	}
+	result, err := parser.Parse(bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("parse dockerfile: %w", err)
+	}
+	if target == "" {
+		target = featureTargetStage
+		content = nameLastStage(content, result.AST, target)
+	}
+
+	containerUser, remoteUser := cmd.featureUsers(plan.Config)
+	staged := []stagedFeature{}
+	for _, feature := range features {
+		s, err := feature.stage(containerUser, remoteUser)
+		if err != nil {
+			return err
+		}
+
+		staged = append(staged, s)
+	}
+
+	stages, lastStage, err := featureStages(target, staged, plan.Config, result.EscapeToken)
+	if err != nil {
+		return err
+	}
+
+	dir := FeaturesDir
+	if cmd.DryRun {
+		dir, err = os.MkdirTemp("", "dockerless-features-")
+		if err != nil {
+			return err
+		}
+	} else {
+		err = stageFeatures(staged)
+		if err != nil {
+			return err
+		}
+	}
+
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	err = os.WriteFile(dockerfile, append(content, []byte(stages)...), 0644)
+	if err != nil {
+		return fmt.Errorf("write dockerfile: %w", err)
+	}
+
+	// kaniko looks for a Dockerfile specific .dockerignore next to the Dockerfile
+	if _, err := os.Stat(opts.DockerfilePath + ".dockerignore"); err == nil {
+		err = copyFile(opts.DockerfilePath+".dockerignore", dockerfile+".dockerignore")
+		if err != nil {
+			return fmt.Errorf("copy dockerignore: %w", err)
+		}
+	}
+
+	opts.DockerfilePath = dockerfile
+	opts.Target = lastStage
+	return nil
+}
+
+// featureUsers returns the user the container is created with and the user that is used inside of it
+func (cmd *BuildCmd) featureUsers(imageConfig v1.Config) (string, string) {
+	containerUser, _, _ := strings.Cut(imageConfig.User, ":")
+	if containerUser == "" {
+		containerUser = "root"
+	}
+	if cmd.devContainer != nil && cmd.devContainer.ContainerUser != "" {
+		containerUser = cmd.devContainer.ContainerUser
+	}
+
+	remoteUser := containerUser
+	if cmd.devContainer != nil && cmd.devContainer.RemoteUser != "" {
+		remoteUser = cmd.devContainer.RemoteUser
+	}
+
+	return containerUser, remoteUser
+}
+
+// nameLastStage adds a name to the last FROM instruction, so we can build on top of it
+func nameLastStage(content []byte, ast *parser.Node, name string) []byte {
+	endLine := 0
+	for _, node := range ast.Children {
+		if strings.EqualFold(node.Value, "from") {
+			endLine = node.EndLine
+		}
+	}
+	if endLine == 0 {
+		return content
+	}
+
+	lines := strings.Split(string(content), "\n")
+	lines[endLine-1] = strings.TrimRight(lines[endLine-1], " \t\r") + " AS " + name
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// featureStages returns a stage for every Feature on top of target and the name of the last one. The
+// last stage restores the user of the target and adds the entrypoints and metadata of the Features.
+func featureStages(target string, staged []stagedFeature, imageConfig v1.Config, escapeToken rune) (string, string, error) {
+	out := &strings.Builder{}
+	base := target
+	for i, s := range staged {
+		stage := featureStagePrefix + strconv.Itoa(i)
+		fmt.Fprintf(out, "\nFROM %s AS %s\nUSER root\n", base, stage)
+
+		names := make([]string, 0, len(s.feature.ContainerEnv))
+		for name := range s.feature.ContainerEnv {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := s.feature.ContainerEnv[name]
+			if name == "" || strings.ContainsAny(name, "= \t\r\n") || strings.ContainsAny(value, "\r\n") {
+				return "", "", fmt.Errorf("feature %s has an invalid containerEnv %s", s.feature.ID, name)
+			}
+
+			fmt.Fprintf(out, "ENV %s=%s\n", name, quoteDockerfileValue(value, escapeToken, false))
+		}
+
+		fmt.Fprintf(out, "RUN cd %s && set -a && . ./%s && set +a && ./install.sh\n", s.dir, featureEnvFile)
+		base = stage
+	}
+
+	if imageConfig.User != "" {
+		fmt.Fprintf(out, "USER %s\n", imageConfig.User)
+	}
+
+	// the Feature entrypoints run before the entrypoint of the image, like the devcontainer CLI does it
+	entrypoints := []string{}
+	for _, s := range staged {
+		if s.feature.Entrypoint != "" {
+			entrypoints = append(entrypoints, s.feature.Entrypoint)
+		}
+	}
+	if len(entrypoints) > 0 {
+		exec := "exec"
+		for _, arg := range imageConfig.Entrypoint {
+			exec += " " + shellQuote(arg)
+		}
+
+		entrypoint, err := json.Marshal([]string{"/bin/sh", "-c", strings.Join(append(entrypoints, exec+` "$@"`), "\n"), "-"})
+		if err != nil {
+			return "", "", err
+		}
+
+		fmt.Fprintf(out, "ENTRYPOINT %s\n", entrypoint)
+	}
+
+	metadata, err := featureMetadataLabel(imageConfig.Labels[devContainerMetadataLabel], staged)
+	if err != nil {
+		return "", "", err
+	}
+	fmt.Fprintf(out, "LABEL %s=%s\n", devContainerMetadataLabel, quoteDockerfileValue(metadata, escapeToken, true))
+
+	return out.String(), base, nil
+}
+
+// featureMetadataLabel appends the Features to the devcontainer.metadata label of the target,
+// which is either a single object or a list of objects
+func featureMetadataLabel(existing string, staged []stagedFeature) (string, error) {
+	metadata := []json.RawMessage{}
+	if existing != "" {
+		err := json.Unmarshal([]byte(existing), &metadata)
+		if err != nil {
+			entry := map[string]interface{}{}
+			if json.Unmarshal([]byte(existing), &entry) == nil {
+				metadata = []json.RawMessage{json.RawMessage(existing)}
+			} else {
+				fmt.Printf("warning: replacing invalid %s label of the target\n", devContainerMetadataLabel)
+			}
+		}
+	}
+
+	for _, s := range staged {
+		entry, err := json.Marshal(featureMetadata{
+			ID:           s.feature.ID,
+			ContainerEnv: s.feature.ContainerEnv,
+			Entrypoint:   s.feature.Entrypoint,
+			CapAdd:       s.feature.CapAdd,
+			SecurityOpt:  s.feature.SecurityOpt,
+			Privileged:   s.feature.Privileged,
+			Init:         s.feature.Init,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		metadata = append(metadata, entry)
+	}
+
+	out, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// quoteDockerfileValue double quotes value for ENV and LABEL. Variables are only expanded if literal is false.
+func quoteDockerfileValue(value string, escapeToken rune, literal bool) string {
+	escape := string(escapeToken)
+	replacements := []string{escape, escape + escape, `"`, escape + `"`}
+	if literal {
+		replacements = append(replacements, "$", escape+"$")
+	}
+
+	return `"` + strings.NewReplacer(replacements...).Replace(value) + `"`
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+)
+
+func TestParseFeatureFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    featureRef
+		wantErr bool
+	}{
+		{value: "./go", want: featureRef{Path: "./go", Options: map[string]string{}}},
+		{value: "./go,version=1.22,tools=", want: featureRef{Path: "./go", Options: map[string]string{"version": "1.22", "tools": ""}}},
+		{value: ",version=1.22", wantErr: true},
+		{value: "./go,version", wantErr: true},
+		{value: "./go,=1.22", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseFeatureFlag(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.value)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %+v, got %+v", test.value, test.want, got)
+		}
+	}
+}
+
+func TestResolveFeatures(t *testing.T) {
+	dir := t.TempDir()
+	writeFeature(t, filepath.Join(dir, "features", "go"), `{"id": "go", "installsAfter": ["ghcr.io/devcontainers/features/common-utils:2"]}`)
+	writeFeature(t, filepath.Join(dir, "features", "common-utils"), `{"id": "common-utils"}`)
+	writeFeature(t, filepath.Join(dir, "features", "node"), `{"id": "node", "options": {"version": {"type": "string", "default": "lts"}}}`)
+	t.Setenv("DOCKERLESS_FEATURES", `["`+filepath.Join(dir, "features", "node")+`,version=20"]`)
+
+	cmd := &BuildCmd{
+		devContainer: &DevContainerConfig{
+			path: filepath.Join(dir, "devcontainer.json"),
+			Features: map[string]interface{}{
+				"./features/go":                     map[string]interface{}{"version": 1.22, "tools": true},
+				"./features/common-utils":           "latest",
+				"./features/disabled":               false,
+				"ghcr.io/devcontainers/features/go": map[string]interface{}{},
+			},
+			OverrideFeatureInstallOrder: []string{"./features/go"},
+		},
+		Features: []string{filepath.Join(dir, "features", "go") + ",version=1.23"},
+	}
+	features, err := cmd.resolveFeatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, feature := range features {
+		ids = append(ids, feature.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"common-utils", "go", "node"}) {
+		t.Fatalf("expected features common-utils, go and node, got %v", ids)
+	}
+	if !reflect.DeepEqual(features[1].options, map[string]string{"version": "1.23", "tools": "true"}) {
+		t.Fatalf("expected flag options to be merged, got %v", features[1].options)
+	}
+	if !reflect.DeepEqual(features[2].options, map[string]string{"version": "20"}) {
+		t.Fatalf("expected env options, got %v", features[2].options)
+	}
+
+	cmd = &BuildCmd{Features: []string{filepath.Join(dir, "features", "missing")}}
+	_, err = cmd.resolveFeatures()
+	if err == nil {
+		t.Fatal("expected error for missing feature")
+	}
+}
+
+func TestReadFeature(t *testing.T) {
+	tests := []struct {
+		name    string
+		feature string
+		install bool
+		wantErr bool
+	}{
+		{name: "valid", feature: `{"id": "go", /* comment */ "version": "1.0.0",}`, install: true},
+		{name: "invalid id", feature: `{"id": "../go"}`, install: true, wantErr: true},
+		{name: "invalid json", feature: `{"id": `, install: true, wantErr: true},
+		{name: "missing install.sh", feature: `{"id": "go"}`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, "devcontainer-feature.json"), test.feature)
+			if test.install {
+				writeFile(t, filepath.Join(dir, "install.sh"), "#!/bin/sh\n")
+			}
+
+			feature, err := readFeature(dir)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if feature.ID != "go" || feature.dir != dir {
+				t.Fatalf("unexpected feature %+v", feature)
+			}
+		})
+	}
+}
+
+func TestFeatureEnvFile(t *testing.T) {
+	feature := &DevContainerFeature{
+		ID: "go",
+		Options: map[string]FeatureOption{
+			"version":       {Type: "string", Default: "latest"},
+			"installTools":  {Type: "boolean", Default: true},
+			"1-golangciVer": {Type: "string"},
+		},
+		options: map[string]string{"version": "1.22", "1-golangciVer": "it's"},
+	}
+
+	got := string(feature.envFile("root", "vscode"))
+	for _, line := range []string{
+		"_GOLANGCIVER='it'\\''s'\n",
+		"INSTALLTOOLS='true'\n",
+		"VERSION='1.22'\n",
+		"_CONTAINER_USER='root'\n",
+		"_REMOTE_USER='vscode'\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Fatalf("expected %q in env file:\n%s", line, got)
+		}
+	}
+}
+
+func TestApplyFeatures(t *testing.T) {
+	contextDir := t.TempDir()
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	writeFile(t, dockerfile, "FROM scratch\nUSER 1000\n")
+	writeFile(t, dockerfile+".dockerignore", "*.log\n")
+	writeFeature(t, filepath.Join(contextDir, "go"), `{"id": "go", "containerEnv": {"GOPATH": "/go"}, "entrypoint": "/usr/local/share/go-init.sh"}`)
+	FeaturesDir = filepath.Join(t.TempDir(), "features")
+
+	for _, dryRun := range []bool{false, true} {
+		opts := &config.KanikoOptions{DockerfilePath: dockerfile, SrcContext: contextDir}
+		cmd := &BuildCmd{DryRun: dryRun}
+		features, err := (&BuildCmd{Features: []string{filepath.Join(contextDir, "go")}}).resolveFeatures()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = cmd.applyFeatures(opts, newBaseImageResolver(opts, nil), features)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opts.Target != featureStagePrefix+"0" {
+			t.Fatalf("expected target %s, got %s", featureStagePrefix+"0", opts.Target)
+		}
+		if dryRun == (filepath.Dir(opts.DockerfilePath) == FeaturesDir) {
+			t.Fatalf("dry run %v wrote the dockerfile to %s", dryRun, opts.DockerfilePath)
+		}
+		if _, err := os.Stat(opts.DockerfilePath + ".dockerignore"); err != nil {
+			t.Fatalf("expected dockerignore next to the generated dockerfile: %v", err)
+		}
+
+		content, err := os.ReadFile(opts.DockerfilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, instruction := range []string{
+			"FROM scratch AS " + featureTargetStage,
+			"FROM " + featureTargetStage + " AS " + featureStagePrefix + "0",
+			"ENV GOPATH=\"/go\"",
+			"USER 1000",
+			"ENTRYPOINT [\"/bin/sh\",\"-c\",\"/usr/local/share/go-init.sh\\nexec \\\"$@\\\"\",\"-\"]",
+		} {
+			if !strings.Contains(string(content), instruction) {
+				t.Fatalf("expected %s in dockerfile:\n%s", instruction, content)
+			}
+		}
+
+		staged, _ := filepath.Glob(filepath.Join(FeaturesDir, "go-*", "install.sh"))
+		if dryRun != (len(staged) == 0) {
+			t.Fatalf("dry run %v staged features %v", dryRun, staged)
+		}
+
+		err = os.RemoveAll(filepath.Dir(opts.DockerfilePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFeatureMetadataLabel(t *testing.T) {
+	staged := []stagedFeature{{feature: &DevContainerFeature{ID: "go", CapAdd: []string{"SYS_PTRACE"}}}}
+	tests := map[string]string{
+		"":                       `[{"id":"go","capAdd":["SYS_PTRACE"]}]`,
+		`{"remoteUser":"dev"}`:   `[{"remoteUser":"dev"},{"id":"go","capAdd":["SYS_PTRACE"]}]`,
+		`[{"remoteUser":"dev"}]`: `[{"remoteUser":"dev"},{"id":"go","capAdd":["SYS_PTRACE"]}]`,
+		"invalid":                `[{"id":"go","capAdd":["SYS_PTRACE"]}]`,
+	}
+	for existing, want := range tests {
+		got, err := featureMetadataLabel(existing, staged)
+		if err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("%s: expected %s, got %s", existing, want, got)
+		}
+	}
+}
+
+func writeFeature(t *testing.T, dir, feature string) {
+	t.Helper()
+
+	writeFile(t, filepath.Join(dir, "devcontainer-feature.json"), feature)
+	writeFile(t, filepath.Join(dir, "install.sh"), "#!/bin/sh\n")
+}
@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/executor"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+var FingerprintOutput = "/.dockerless/fingerprint.json"
+
+// BuildFingerprint describes the inputs an image was built from. Build args are
+// only stored as hash, as they might contain secrets.
+type BuildFingerprint struct {
+	Hash         string            `json:"hash"`
+	Dockerfile   string            `json:"dockerfile"`
+	Target       string            `json:"target,omitempty"`
+	BuildArgs    string            `json:"buildArgs"`
+	Labels       string            `json:"labels,omitempty"`
+	Outputs      []string          `json:"outputs,omitempty"`
+	BaseImages   map[string]string `json:"baseImages,omitempty"`
+	ContextFiles string            `json:"contextFiles"`
+}
+
+// calculateFingerprint resolves all inputs of the build described by opts and hashes them together
+// with the outputs the image is written to
+func calculateFingerprint(ctx context.Context, opts *config.KanikoOptions, images *baseImageResolver, outputs []string) (*BuildFingerprint, error) {
+	dockerfileContent, err := readDockerfile(ctx, opts.DockerfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("read dockerfile: %w", err)
+	}
+
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	if err != nil {
+		return nil, fmt.Errorf("parse dockerfile: %w", err)
+	}
+
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	if err != nil {
+		return nil, fmt.Errorf("resolve stages: %w", err)
+	}
+	executor.ResolveCrossStageInstructions(kanikoStages)
+
+	fileContext, err := util.NewFileContextFromDockerfile(opts.DockerfilePath, opts.SrcContext)
+	if err != nil {
+		return nil, fmt.Errorf("create file context: %w", err)
+	}
+
+	baseImages := map[string]string{}
+	contextFiles := executor.NewCompositeCache()
+	stageConfigs := map[int]v1.Config{}
+	for _, stage := range kanikoStages {
+		imageConfig, err := stageBaseConfig(stage, images, baseImages, stageConfigs)
+		if err != nil {
+			return nil, err
+		}
+
+		args := dockerfile.NewBuildArgs(opts.BuildArgs)
+		args.AddMetaArgs(stage.MetaArgs)
+		for _, command := range stage.Commands {
+			err = addContextFiles(contextFiles, command, imageConfig, args, fileContext, images, baseImages)
+			if err != nil {
+				return nil, fmt.Errorf("hash context files for %s: %w", command.Name(), err)
+			}
+		}
+
+		stageConfigs[stage.Index] = *imageConfig
+	}
+
+	buildArgs := append([]string{}, opts.BuildArgs...)
+	sort.Strings(buildArgs)
+	fingerprint := &BuildFingerprint{
+		Dockerfile: hashString(string(dockerfileContent)),
+		Target:     opts.Target,
+		BuildArgs:  hashString(strings.Join(buildArgs, "\n")),
+		BaseImages: baseImages,
+		Outputs:    outputs,
+	}
+	if len(opts.Labels) > 0 {
+		labels := append([]string{}, opts.Labels...)
+		sort.Strings(labels)
+		fingerprint.Labels = hashString(strings.Join(labels, "\n"))
+	}
+	fingerprint.ContextFiles, err = contextFiles.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("hash context files: %w", err)
+	}
+
+	fingerprintKey := executor.NewCompositeCache(fingerprint.Dockerfile, fingerprint.Target, fingerprint.BuildArgs, fingerprint.ContextFiles)
+	if fingerprint.Labels != "" {
+		fingerprintKey.AddKey(fingerprint.Labels)
+	}
+	for _, output := range outputs {
+		fingerprintKey.AddKey(output)
+	}
+	baseImageNames := make([]string, 0, len(baseImages))
+	for baseImage := range baseImages {
+		baseImageNames = append(baseImageNames, baseImage)
+	}
+	sort.Strings(baseImageNames)
+	for _, baseImage := range baseImageNames {
+		fingerprintKey.AddKey(baseImage, baseImages[baseImage])
+	}
+	fingerprint.Hash, err = fingerprintKey.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("hash fingerprint: %w", err)
+	}
+
+	return fingerprint, nil
+}
+
+// stageBaseConfig returns the config of the stage's base image and records its digest. If the base
+// image cannot be retrieved, we fall back to the digest of the previous build and an empty config.
+func stageBaseConfig(stage config.KanikoStage, images *baseImageResolver, baseImages map[string]string, stageConfigs map[int]v1.Config) (*v1.Config, error) {
+	if stage.BaseImageStoredLocally {
+		stageConfig := stageConfigs[stage.BaseImageIndex]
+		return &stageConfig, nil
+	} else if stage.BaseName == constants.NoBaseImage {
+		return &v1.Config{Env: constants.ScratchEnvVars}, nil
+	}
+
+	image, err := images.stageImage(stage)
+	if err != nil {
+		digest := images.previousDigest(stage.BaseName, err)
+		if digest == "" {
+			return nil, fmt.Errorf("retrieve base image %s: %w", stage.BaseName, err)
+		}
+
+		baseImages[stage.BaseName] = digest
+		return &v1.Config{Env: constants.ScratchEnvVars}, nil
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("get digest of base image %s: %w", stage.BaseName, err)
+	}
+	baseImages[stage.BaseName] = digest.String()
+
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get config of base image %s: %w", stage.BaseName, err)
+	}
+	if configFile.Config.Env == nil {
+		configFile.Config.Env = constants.ScratchEnvVars
+	}
+
+	return &configFile.Config, nil
+}
+
+// addContextFiles adds all files a COPY or ADD command uses from the context to the given key.
+// Metadata commands are applied to the config, so later sources resolve correctly.
+func addContextFiles(key *executor.CompositeCache, command instructions.Command, imageConfig *v1.Config, args *dockerfile.BuildArgs, fileContext util.FileContext, images *baseImageResolver, baseImages map[string]string) error {
+	var sourcesAndDest instructions.SourcesAndDest
+	switch c := command.(type) {
+	case *instructions.CopyCommand:
+		if c.From != "" {
+			if _, err := strconv.Atoi(c.From); err == nil {
+				return nil
+			}
+
+			// copy from an external image, so we track its digest
+			image, err := images.remoteImage(c.From)
+			if err != nil {
+				digest := images.previousDigest(c.From, err)
+				if digest == "" {
+					return fmt.Errorf("retrieve image %s: %w", c.From, err)
+				}
+
+				baseImages[c.From] = digest
+				return nil
+			}
+			digest, err := image.Digest()
+			if err != nil {
+				return fmt.Errorf("get digest of image %s: %w", c.From, err)
+			}
+
+			baseImages[c.From] = digest.String()
+			return nil
+		}
+
+		sourcesAndDest = c.SourcesAndDest
+	case *instructions.AddCommand:
+		sourcesAndDest = c.SourcesAndDest
+	default:
+		return applyMetadataCommand(command, imageConfig, args, fileContext)
+	}
+
+	sources, _, err := util.ResolveEnvAndWildcards(sourcesAndDest, fileContext, args.ReplacementEnvs(imageConfig.Env))
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		if util.IsSrcRemoteFileURL(source) {
+			key.AddKey(source)
+			continue
+		}
+
+		err = key.AddPath(filepath.Join(fileContext.Root, source), fileContext)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readFingerprint returns the fingerprint of the previous build
+func readFingerprint() (*BuildFingerprint, error) {
+	out, err := os.ReadFile(FingerprintOutput)
+	if err != nil {
+		return nil, fmt.Errorf("read fingerprint: %w", err)
+	}
+
+	fingerprint := &BuildFingerprint{}
+	err = json.Unmarshal(out, fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal fingerprint: %w", err)
+	}
+
+	return fingerprint, nil
+}
+
+func writeFingerprint(fingerprint *BuildFingerprint) error {
+	out, err := json.MarshalIndent(fingerprint, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal fingerprint: %w", err)
+	}
+
+	err = writeStateFile(FingerprintOutput, out)
+	if err != nil {
+		return fmt.Errorf("write fingerprint: %w", err)
+	}
+
+	return nil
+}
+
+// changedInputs returns the names of all inputs that differ between the two fingerprints
+func (f *BuildFingerprint) changedInputs(other *BuildFingerprint) []string {
+	changed := []string{}
+	if f.Dockerfile != other.Dockerfile {
+		changed = append(changed, "dockerfile")
+	}
+	if f.Target != other.Target {
+		changed = append(changed, "target")
+	}
+	if f.BuildArgs != other.BuildArgs {
+		changed = append(changed, "build args")
+	}
+	if f.Labels != other.Labels {
+		changed = append(changed, "labels")
+	}
+	if f.ContextFiles != other.ContextFiles {
+		changed = append(changed, "context files")
+	}
+	if strings.Join(f.Outputs, "\n") != strings.Join(other.Outputs, "\n") {
+		changed = append(changed, "outputs")
+	}
+	for baseImage, digest := range f.BaseImages {
+		if other.BaseImages[baseImage] != digest {
+			changed = append(changed, "base image "+baseImage)
+		}
+	}
+	for baseImage := range other.BaseImages {
+		if _, ok := f.BaseImages[baseImage]; !ok {
+			changed = append(changed, "base image "+baseImage)
+		}
+	}
+
+	return changed
+}
+
+func hashString(value string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+)
+
+// unreachableImage points to a registry that refuses all connections
+const unreachableImage = "127.0.0.1:1/base:latest"
+
+func TestCalculateFingerprintOffline(t *testing.T) {
+	contextDir := t.TempDir()
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	writeFile(t, dockerfile, "FROM "+unreachableImage+"\nCOPY file /file\n")
+	writeFile(t, filepath.Join(contextDir, "file"), "content")
+	opts := &config.KanikoOptions{DockerfilePath: dockerfile, SrcContext: contextDir}
+
+	_, err := calculateFingerprint(context.Background(), opts, newBaseImageResolver(opts, nil), nil)
+	if err == nil {
+		t.Fatal("expected error without previous fingerprint")
+	}
+
+	previous := &BuildFingerprint{BaseImages: map[string]string{unreachableImage: "sha256:1234"}}
+	fingerprint, err := calculateFingerprint(context.Background(), opts, newBaseImageResolver(opts, previous), nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if fingerprint.BaseImages[unreachableImage] != "sha256:1234" {
+		t.Fatalf("expected previous digest, got %v", fingerprint.BaseImages)
+	}
+
+	again, err := calculateFingerprint(context.Background(), opts, newBaseImageResolver(opts, previous), nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if again.Hash != fingerprint.Hash {
+		t.Fatal("expected the same fingerprint for the same inputs")
+	}
+
+	exported, err := calculateFingerprint(context.Background(), opts, newBaseImageResolver(opts, previous), []string{"tar=/workspaces/image.tar"})
+	if err != nil {
+		t.Fatal(err)
+	} else if got := exported.changedInputs(fingerprint); !reflect.DeepEqual(got, []string{"outputs"}) {
+		t.Fatalf("expected changed outputs, got %v", got)
+	}
+
+	writeFile(t, filepath.Join(contextDir, "file"), "changed")
+	changed, err := calculateFingerprint(context.Background(), opts, newBaseImageResolver(opts, previous), nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := changed.changedInputs(fingerprint); !reflect.DeepEqual(got, []string{"context files"}) {
+		t.Fatalf("expected changed context files, got %v", got)
+	}
+}
+
+func TestChangedInputs(t *testing.T) {
+	previous := &BuildFingerprint{
+		Dockerfile: "a",
+		BuildArgs:  "b",
+		BaseImages: map[string]string{"alpine": "sha256:1", "ubuntu": "sha256:2"},
+	}
+	current := &BuildFingerprint{
+		Dockerfile: "a",
+		Target:     "dev",
+		BuildArgs:  "c",
+		BaseImages: map[string]string{"alpine": "sha256:3"},
+	}
+
+	got := current.changedInputs(previous)
+	want := []string{"target", "build args", "base image alpine", "base image ubuntu"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
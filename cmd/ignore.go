@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// IgnoreFile lists extra paths to exclude from deletion, one per line. It is read with every build,
+// so it can be provisioned with the container instead of passing flags.
+var IgnoreFile = "/.dockerless/ignore"
+
+// resolveIgnorePaths collects the ignore paths from the ignore file, DOCKERLESS_IGNORE_PATHS and the flags
+func resolveIgnorePaths(flagPaths []string) ([]util.IgnoreListEntry, error) {
+	filePaths, err := readIgnoreFile(IgnoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	envPaths, err := jsonListFromEnv("DOCKERLESS_IGNORE_PATHS")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []util.IgnoreListEntry{}
+	for _, path := range append(append(filePaths, envPaths...), flagPaths...) {
+		entry, err := parseIgnorePath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// readIgnoreFile reads an ignore file with one path per line. Empty lines and comments are skipped.
+func readIgnoreFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open ignore file: %w", err)
+	}
+	defer file.Close()
+
+	paths := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read ignore file: %w", err)
+	}
+
+	return paths, nil
+}
+
+// parseIgnorePath parses an absolute path that may contain glob patterns in every path component,
+// e.g. /home/*/.cache. A trailing slash switches to prefix mode, which only ignores the contents of
+// the directory, while the directory itself stays part of the image.
+func parseIgnorePath(path string) (util.IgnoreListEntry, error) {
+	if !filepath.IsAbs(path) {
+		return util.IgnoreListEntry{}, fmt.Errorf("invalid ignore path %s: must be absolute", path)
+	}
+
+	_, err := filepath.Match(path, "")
+	if err != nil {
+		return util.IgnoreListEntry{}, fmt.Errorf("invalid ignore path %s: %w", path, err)
+	}
+
+	return util.IgnoreListEntry{
+		Path:            filepath.Clean(path),
+		PrefixMatchOnly: len(path) > 1 && strings.HasSuffix(path, "/"),
+	}, nil
+}
+
+// expandIgnorePaths returns the existing paths matched by glob and prefix entries. kaniko only keeps
+// the parents of exact paths when deleting the filesystem, so we add the matches as exact paths.
+func expandIgnorePaths(entries []util.IgnoreListEntry) []util.IgnoreListEntry {
+	expanded := []util.IgnoreListEntry{}
+	for _, entry := range entries {
+		pattern := entry.Path
+		if entry.PrefixMatchOnly {
+			pattern = filepath.Join(pattern, "*")
+		} else if !strings.ContainsAny(pattern, "*?[\\") {
+			continue
+		}
+
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			expanded = append(expanded, util.IgnoreListEntry{Path: match})
+		}
+	}
+
+	return expanded
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+func TestParseIgnorePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    util.IgnoreListEntry
+		wantErr bool
+	}{
+		{path: "/run/secrets", want: util.IgnoreListEntry{Path: "/run/secrets"}},
+		{path: "/run/secrets/", want: util.IgnoreListEntry{Path: "/run/secrets", PrefixMatchOnly: true}},
+		{path: "/home/*/.cache", want: util.IgnoreListEntry{Path: "/home/*/.cache"}},
+		{path: "/home/../tmp//cache", want: util.IgnoreListEntry{Path: "/tmp/cache"}},
+		{path: "/", want: util.IgnoreListEntry{Path: "/"}},
+		{path: "home/.cache", wantErr: true},
+		{path: "/home/[a", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseIgnorePath(test.path)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.path)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%s: expected %+v, got %+v", test.path, test.want, got)
+		}
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ignore")
+	writeFile(t, path, "# platform paths\n/run/secrets/\n\n  /home/*/.ssh  \n#/tmp\n")
+
+	got, err := readIgnoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, []string{"/run/secrets/", "/home/*/.ssh"}) {
+		t.Fatalf("unexpected paths %v", got)
+	}
+
+	got, err = readIgnoreFile(path + ".missing")
+	if err != nil || len(got) != 0 {
+		t.Fatalf("expected no paths for a missing file, got %v, %v", got, err)
+	}
+}
+
+func TestResolveIgnorePaths(t *testing.T) {
+	IgnoreFile = filepath.Join(t.TempDir(), "ignore")
+	writeFile(t, IgnoreFile, "/from/file\n")
+	t.Setenv("DOCKERLESS_IGNORE_PATHS", `["/from/env/"]`)
+
+	got, err := resolveIgnorePaths([]string{"/from/flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []util.IgnoreListEntry{{Path: "/from/file"}, {Path: "/from/env", PrefixMatchOnly: true}, {Path: "/from/flag"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	_, err = resolveIgnorePaths([]string{"relative"})
+	if err == nil {
+		t.Fatal("expected error for relative path")
+	}
+
+	t.Setenv("DOCKERLESS_IGNORE_PATHS", `/not/json`)
+	_, err = resolveIgnorePaths(nil)
+	if err == nil {
+		t.Fatal("expected error for invalid env")
+	}
+}
+
+func TestExpandIgnorePaths(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "home", "alice", ".cache", "file"), "")
+	writeFile(t, filepath.Join(root, "home", "bob", ".cache", "file"), "")
+	writeFile(t, filepath.Join(root, "home", "carol", ".config"), "")
+	writeFile(t, filepath.Join(root, "run", "secrets", "token"), "")
+	writeFile(t, filepath.Join(root, "run", "secrets", "key"), "")
+
+	got := expandIgnorePaths([]util.IgnoreListEntry{
+		{Path: filepath.Join(root, "home", "*", ".cache")},
+		{Path: filepath.Join(root, "run", "secrets"), PrefixMatchOnly: true},
+		{Path: filepath.Join(root, "exact")},
+	})
+	paths := []string{}
+	for _, entry := range got {
+		if entry.PrefixMatchOnly {
+			t.Fatalf("expected exact entries, got %+v", entry)
+		}
+		paths = append(paths, entry.Path)
+	}
+	sort.Strings(paths)
+
+	want := []string{
+		filepath.Join(root, "home", "alice", ".cache"),
+		filepath.Join(root, "home", "bob", ".cache"),
+		filepath.Join(root, "run", "secrets", "key"),
+		filepath.Join(root, "run", "secrets", "token"),
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("expected %v, got %v", want, paths)
+	}
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrBuildInterrupted = errors.New("build interrupted")
+
+// interruptGracePeriod is how long we wait for the build to stop after it was interrupted
+const interruptGracePeriod = 10 * time.Second
+
+// cancelDownloads replaces the default http transport, which kaniko clones for every registry
+// and remote file, with one that closes all its connections as soon as ctx is done.
+func cancelDownloads(ctx context.Context) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	tracker := &connTracker{conns: map[net.Conn]struct{}{}}
+	go func() {
+		<-ctx.Done()
+		tracker.closeAll()
+	}()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(dialCtx context.Context, network, address string) (net.Conn, error) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		conn, err := dialer.DialContext(dialCtx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		return tracker.track(conn), nil
+	}
+	http.DefaultTransport = transport
+}
+
+// connTracker remembers all open connections, so we can abort them
+type connTracker struct {
+	conns  map[net.Conn]struct{}
+	closed bool
+	m      sync.Mutex
+}
+
+func (t *connTracker) track(conn net.Conn) net.Conn {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.closed {
+		_ = conn.Close()
+		return conn
+	}
+
+	tracked := &trackedConn{Conn: conn, tracker: t}
+	t.conns[tracked] = struct{}{}
+	return tracked
+}
+
+func (t *connTracker) untrack(conn net.Conn) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	delete(t.conns, conn)
+}
+
+func (t *connTracker) closeAll() {
+	t.m.Lock()
+	t.closed = true
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.m.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.untrack(c)
+	return c.Conn.Close()
+}
+
+// killChildProcessGroups kills all process groups of our child processes. kaniko starts every
+// RUN command in its own process group, so this also kills everything the command has started.
+func killChildProcessGroups() {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return
+	}
+
+	for _, stat := range stats {
+		out, err := os.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+
+		// stat looks like: 42 (sh) S 1 42 ..., the command name may contain spaces and parentheses
+		content := string(out)
+		fields := strings.Fields(content[strings.LastIndex(content, ")")+1:])
+		if len(fields) < 3 {
+			continue
+		}
+
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil || ppid != os.Getpid() {
+			continue
+		}
+
+		pgid, err := strconv.Atoi(fields[2])
+		if err != nil || pgid == syscall.Getpgrp() {
+			continue
+		}
+
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCancelDownloads(t *testing.T) {
+	defaultTransport := http.DefaultTransport
+	defer func() {
+		http.DefaultTransport = defaultTransport
+	}()
+
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelDownloads(ctx)
+
+	// kaniko clones the default transport, so the clone has to be cancelled as well
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := resp.Body.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the download to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download was not aborted")
+	}
+
+	_, err = client.Get(server.URL)
+	if err == nil {
+		t.Fatal("expected new connections to fail after the build was interrupted")
+	}
+}
+
+func TestKillChildProcessGroups(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	killChildProcessGroups()
+	select {
+	case <-done:
+		if cmd.ProcessState.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+			t.Fatalf("expected process to be killed, got %s", cmd.ProcessState)
+		}
+	case <-time.After(5 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatal("child process group was not killed")
+	}
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/containerd/containerd/platforms"
+)
+
+const (
+	defaultCompression      = config.ZStd
+	defaultCompressionLevel = 3
+	defaultSnapshotMode     = constants.SnapshotModeRedo
+	defaultCacheTTL         = time.Hour * 24 * 7
+)
+
+// maxCompressionLevels are the highest compression levels supported by each compression
+var maxCompressionLevels = map[config.Compression]int{
+	config.GZip: 9,
+	config.ZStd: 22,
+}
+
+var snapshotModes = map[string]bool{
+	constants.SnapshotModeFull: true,
+	constants.SnapshotModeRedo: true,
+	constants.SnapshotModeTime: true,
+}
+
+// parseBuildOptions fills the build options that were not set through flags from the
+// environment, applies the defaults and validates them before anything is built.
+func (cmd *BuildCmd) parseBuildOptions() error {
+	// platform
+	platform, err := resolvePlatform(cmd.Platform)
+	if err != nil {
+		return err
+	}
+	cmd.Platform = platform
+
+	// compression
+	if cmd.Compression == "" {
+		if compression := os.Getenv("DOCKERLESS_COMPRESSION"); compression != "" {
+			err := cmd.Compression.Set(compression)
+			if err != nil {
+				return fmt.Errorf("invalid DOCKERLESS_COMPRESSION %s: %w", compression, err)
+			}
+		} else {
+			cmd.Compression = defaultCompression
+		}
+	}
+
+	// compression level
+	if cmd.CompressionLevel == 0 {
+		if compressionLevel := os.Getenv("DOCKERLESS_COMPRESSION_LEVEL"); compressionLevel != "" {
+			level, err := strconv.Atoi(compressionLevel)
+			if err != nil {
+				return fmt.Errorf("invalid DOCKERLESS_COMPRESSION_LEVEL %s: %w", compressionLevel, err)
+			}
+
+			cmd.CompressionLevel = level
+		} else {
+			cmd.CompressionLevel = defaultCompressionLevel
+		}
+	}
+	if cmd.CompressionLevel < 1 || cmd.CompressionLevel > maxCompressionLevels[cmd.Compression] {
+		return fmt.Errorf("invalid --compression-level %d: must be between 1 and %d for %s", cmd.CompressionLevel, maxCompressionLevels[cmd.Compression], cmd.Compression)
+	}
+
+	// snapshot mode
+	if cmd.SnapshotMode == "" {
+		cmd.SnapshotMode = os.Getenv("DOCKERLESS_SNAPSHOT_MODE")
+		if cmd.SnapshotMode == "" {
+			cmd.SnapshotMode = defaultSnapshotMode
+		}
+	}
+	if !snapshotModes[cmd.SnapshotMode] {
+		return fmt.Errorf("invalid --snapshot-mode %s: must be one of full, redo or time", cmd.SnapshotMode)
+	}
+
+	// cache ttl
+	cmd.CacheTTL, err = resolveCacheTTL(cmd.CacheTTL)
+	if err != nil {
+		return err
+	}
+
+	// cache max size
+	if cmd.CacheMaxSize == "" {
+		cmd.CacheMaxSize = os.Getenv("DOCKERLESS_CACHE_MAX_SIZE")
+	}
+	cmd.cacheMaxSize, err = parseCacheMaxSize(cmd.CacheMaxSize)
+	if err != nil {
+		return err
+	}
+
+	// explain cache
+	if !cmd.ExplainCache {
+		if explainCache := os.Getenv("DOCKERLESS_EXPLAIN_CACHE"); explainCache != "" {
+			cmd.ExplainCache, err = strconv.ParseBool(explainCache)
+			if err != nil {
+				return fmt.Errorf("invalid DOCKERLESS_EXPLAIN_CACHE %s: %w", explainCache, err)
+			}
+		}
+	}
+
+	// skip disk space check
+	if !cmd.SkipDiskSpaceCheck {
+		if skipDiskSpaceCheck := os.Getenv("DOCKERLESS_SKIP_DISK_SPACE_CHECK"); skipDiskSpaceCheck != "" {
+			cmd.SkipDiskSpaceCheck, err = strconv.ParseBool(skipDiskSpaceCheck)
+			if err != nil {
+				return fmt.Errorf("invalid DOCKERLESS_SKIP_DISK_SPACE_CHECK %s: %w", skipDiskSpaceCheck, err)
+			}
+		}
+	}
+
+	// labels, flags take precedence over the environment
+	envLabels, err := jsonListFromEnv("DOCKERLESS_LABELS")
+	if err != nil {
+		return err
+	}
+	cmd.Labels = append(envLabels, cmd.Labels...)
+	cmd.labels, err = parseLabels(cmd.Labels)
+	if err != nil {
+		return err
+	}
+
+	// ignore paths from the ignore file, the environment and the flags
+	cmd.ignorePaths, err = resolveIgnorePaths(cmd.IgnorePaths)
+	if err != nil {
+		return err
+	}
+
+	// persist paths, flags are added to the environment
+	envPersistPaths, err := jsonListFromEnv("DOCKERLESS_PERSIST_PATHS")
+	if err != nil {
+		return err
+	}
+	cmd.PersistPaths = append(envPersistPaths, cmd.PersistPaths...)
+	for _, path := range cmd.PersistPaths {
+		err = validatePersistPath(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// shared cache dir
+	err = cmd.parseSharedCacheDir()
+	if err != nil {
+		return err
+	}
+
+	return cmd.parseRegistryOptions()
+}
+
+// resolvePlatform falls back to DOCKERLESS_PLATFORM and the platform dockerless runs on and normalizes it
+func resolvePlatform(platform string) (string, error) {
+	if platform == "" {
+		platform = os.Getenv("DOCKERLESS_PLATFORM")
+	}
+	if platform == "" {
+		return platforms.Format(platforms.Normalize(platforms.DefaultSpec())), nil
+	}
+
+	parsed, err := platforms.Parse(platform)
+	if err != nil {
+		return "", fmt.Errorf("invalid --platform %s: %w", platform, err)
+	}
+
+	return platforms.Format(platforms.Normalize(parsed)), nil
+}
+
+// resolveCacheTTL falls back to DOCKERLESS_CACHE_TTL and the default cache ttl
+func resolveCacheTTL(cacheTTL time.Duration) (time.Duration, error) {
+	if cacheTTL == 0 {
+		if envCacheTTL := os.Getenv("DOCKERLESS_CACHE_TTL"); envCacheTTL != "" {
+			ttl, err := time.ParseDuration(envCacheTTL)
+			if err != nil {
+				return 0, fmt.Errorf("invalid DOCKERLESS_CACHE_TTL %s: %w", envCacheTTL, err)
+			}
+
+			cacheTTL = ttl
+		} else {
+			cacheTTL = defaultCacheTTL
+		}
+	}
+	if cacheTTL < 0 {
+		return 0, fmt.Errorf("invalid --cache-ttl %s: must not be negative", cacheTTL)
+	}
+
+	return cacheTTL, nil
+}
+
+// parseSharedCacheDir resolves the shared cache dir from --cache-dir-shared, DOCKERLESS_CACHE_DIR_SHARED
+// or an oci: prefixed --registry-cache. The oci: prefix is optional for --cache-dir-shared.
+func (cmd *BuildCmd) parseSharedCacheDir() error {
+	if cmd.SharedCacheDir == "" {
+		cmd.SharedCacheDir = os.Getenv("DOCKERLESS_CACHE_DIR_SHARED")
+	}
+
+	if cmd.SharedCacheDir != "" {
+		if cmd.RegistryCache != "" {
+			return fmt.Errorf("--cache-dir-shared and --registry-cache cannot be used together")
+		}
+
+		cmd.sharedCacheDir = filepath.Clean(strings.TrimPrefix(cmd.SharedCacheDir, ociCachePrefix))
+	} else {
+		cmd.sharedCacheDir = sharedCacheDirFromRepo(cmd.RegistryCache)
+	}
+
+	if cmd.sharedCacheDir != "" && !filepath.IsAbs(cmd.sharedCacheDir) {
+		return fmt.Errorf("invalid shared cache dir %s: must be an absolute path", cmd.sharedCacheDir)
+	}
+
+	return nil
+}
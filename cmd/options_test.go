@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+)
+
+func TestParseBuildOptions(t *testing.T) {
+	IgnoreFile = filepath.Join(t.TempDir(), "ignore")
+
+	tests := []struct {
+		name    string
+		cmd     BuildCmd
+		env     map[string]string
+		check   func(t *testing.T, cmd *BuildCmd)
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cmd *BuildCmd) {
+				if cmd.Compression != defaultCompression || cmd.CompressionLevel != defaultCompressionLevel || cmd.SnapshotMode != defaultSnapshotMode || cmd.CacheTTL != defaultCacheTTL {
+					t.Fatalf("unexpected defaults %s %d %s %s", cmd.Compression, cmd.CompressionLevel, cmd.SnapshotMode, cmd.CacheTTL)
+				}
+				if cmd.Platform == "" {
+					t.Fatal("expected host platform")
+				}
+			},
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				"DOCKERLESS_PLATFORM":          "linux/arm64",
+				"DOCKERLESS_COMPRESSION":       "gzip",
+				"DOCKERLESS_COMPRESSION_LEVEL": "9",
+				"DOCKERLESS_SNAPSHOT_MODE":     "time",
+				"DOCKERLESS_CACHE_TTL":         "1h",
+			},
+			check: func(t *testing.T, cmd *BuildCmd) {
+				if cmd.Platform != "linux/arm64" || cmd.Compression != config.GZip || cmd.CompressionLevel != 9 || cmd.SnapshotMode != constants.SnapshotModeTime || cmd.CacheTTL != time.Hour {
+					t.Fatalf("environment was not applied: %s %s %d %s %s", cmd.Platform, cmd.Compression, cmd.CompressionLevel, cmd.SnapshotMode, cmd.CacheTTL)
+				}
+			},
+		},
+		{
+			name: "flags take precedence",
+			cmd:  BuildCmd{Platform: "linux/amd64", Compression: config.ZStd, CompressionLevel: 19, SnapshotMode: constants.SnapshotModeFull, CacheTTL: time.Minute},
+			env: map[string]string{
+				"DOCKERLESS_PLATFORM":          "linux/arm64",
+				"DOCKERLESS_COMPRESSION":       "gzip",
+				"DOCKERLESS_COMPRESSION_LEVEL": "1",
+				"DOCKERLESS_SNAPSHOT_MODE":     "time",
+				"DOCKERLESS_CACHE_TTL":         "1h",
+			},
+			check: func(t *testing.T, cmd *BuildCmd) {
+				if cmd.Platform != "linux/amd64" || cmd.Compression != config.ZStd || cmd.CompressionLevel != 19 || cmd.SnapshotMode != constants.SnapshotModeFull || cmd.CacheTTL != time.Minute {
+					t.Fatalf("flags were overridden: %s %s %d %s %s", cmd.Platform, cmd.Compression, cmd.CompressionLevel, cmd.SnapshotMode, cmd.CacheTTL)
+				}
+			},
+		},
+		{name: "invalid platform", cmd: BuildCmd{Platform: "linux/amd64/v2/extra"}, wantErr: true},
+		{name: "invalid compression", env: map[string]string{"DOCKERLESS_COMPRESSION": "lz4"}, wantErr: true},
+		{name: "gzip level too high", cmd: BuildCmd{Compression: config.GZip, CompressionLevel: 10}, wantErr: true},
+		{name: "zstd level too high", cmd: BuildCmd{CompressionLevel: 23}, wantErr: true},
+		{name: "invalid compression level", env: map[string]string{"DOCKERLESS_COMPRESSION_LEVEL": "fast"}, wantErr: true},
+		{name: "invalid snapshot mode", cmd: BuildCmd{SnapshotMode: "fast"}, wantErr: true},
+		{name: "invalid cache ttl", env: map[string]string{"DOCKERLESS_CACHE_TTL": "1 week"}, wantErr: true},
+		{name: "negative cache ttl", cmd: BuildCmd{CacheTTL: -time.Hour}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			cmd := test.cmd
+			err := cmd.parseBuildOptions()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			test.check(t, &cmd)
+		})
+	}
+}
+
+func TestParseSharedCacheDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     BuildCmd
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "flag", cmd: BuildCmd{SharedCacheDir: "/mnt/cache"}, want: "/mnt/cache"},
+		{name: "flag with prefix", cmd: BuildCmd{SharedCacheDir: "oci:/mnt/cache/"}, want: "/mnt/cache"},
+		{name: "environment", env: "oci:/mnt/env", want: "/mnt/env"},
+		{name: "flag takes precedence", cmd: BuildCmd{SharedCacheDir: "/mnt/cache"}, env: "/mnt/env", want: "/mnt/cache"},
+		{name: "registry cache", cmd: BuildCmd{RegistryCache: "oci:/mnt/cache"}, want: "/mnt/cache"},
+		{name: "remote registry cache", cmd: BuildCmd{RegistryCache: "my.registry/cache"}},
+		{name: "relative", cmd: BuildCmd{SharedCacheDir: "cache"}, wantErr: true},
+		{name: "both", cmd: BuildCmd{SharedCacheDir: "/mnt/cache", RegistryCache: "my.registry/cache"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DOCKERLESS_CACHE_DIR_SHARED", test.env)
+
+			cmd := test.cmd
+			err := cmd.parseSharedCacheDir()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if cmd.sharedCacheDir != test.want {
+				t.Fatalf("expected %q, got %q", test.want, cmd.sharedCacheDir)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// PersistDir keeps the persisted paths while the filesystem is rebuilt
+var PersistDir = "/.dockerless/persist"
+
+// validatePersistPath checks that path is an absolute path or glob pattern outside of /.dockerless
+func validatePersistPath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) == "/" {
+		return fmt.Errorf("invalid persist path %s: must be an absolute path below /", path)
+	} else if isSubPath("/.dockerless", filepath.Clean(path)) {
+		return fmt.Errorf("invalid persist path %s: /.dockerless is never deleted", path)
+	}
+
+	_, err := filepath.Match(path, "")
+	if err != nil {
+		return fmt.Errorf("invalid persist path %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// persistPaths copies the paths matched by patterns to PersistDir, before the filesystem is deleted.
+// Paths saved by a build that failed before restoring them are kept, unless they exist again.
+func persistPaths(patterns []string) error {
+	saved, err := readPersistedPaths()
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Join(PersistDir, "root")
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("persist %s: %w", pattern, err)
+		}
+
+		for _, path := range matches {
+			err = os.RemoveAll(filepath.Join(root, path))
+			if err != nil {
+				return fmt.Errorf("persist %s: %w", path, err)
+			}
+
+			err = os.MkdirAll(root, 0700)
+			if err != nil {
+				return fmt.Errorf("persist %s: %w", path, err)
+			}
+
+			err = copyParents("/", root, path)
+			if err != nil {
+				return fmt.Errorf("persist %s: %w", path, err)
+			}
+
+			err = copyTree(path, filepath.Join(root, path), nil)
+			if err != nil {
+				return fmt.Errorf("persist %s: %w", path, err)
+			}
+
+			saved = append(saved, path)
+		}
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+
+	out, err := json.Marshal(outermostPaths(saved))
+	if err != nil {
+		return err
+	}
+
+	return writeStateFile(filepath.Join(PersistDir, "paths.json"), out)
+}
+
+// restorePersistedPaths copies the persisted paths back on top of the built image and returns the
+// files of the image that were replaced. PersistDir is removed afterwards.
+func restorePersistedPaths() ([]string, error) {
+	saved, err := readPersistedPaths()
+	if err != nil || len(saved) == 0 {
+		return nil, err
+	}
+
+	conflicts := []string{}
+	root := filepath.Join(PersistDir, "root")
+	for _, path := range saved {
+		err = copyParents(root, "/", path)
+		if err != nil {
+			return nil, fmt.Errorf("restore %s: %w", path, err)
+		}
+
+		err = copyTree(filepath.Join(root, path), path, func(target string) {
+			conflicts = append(conflicts, target)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("restore %s: %w", path, err)
+		}
+	}
+
+	err = os.RemoveAll(PersistDir)
+	if err != nil {
+		return nil, fmt.Errorf("remove persisted paths: %w", err)
+	}
+
+	return conflicts, nil
+}
+
+func readPersistedPaths() ([]string, error) {
+	out, err := os.ReadFile(filepath.Join(PersistDir, "paths.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read persisted paths: %w", err)
+	}
+
+	paths := []string{}
+	err = json.Unmarshal(out, &paths)
+	if err != nil {
+		return nil, fmt.Errorf("parse persisted paths: %w", err)
+	}
+
+	return paths, nil
+}
+
+// outermostPaths removes duplicates and paths that are contained in other paths
+func outermostPaths(paths []string) []string {
+	sort.Strings(paths)
+
+	outermost := []string{}
+	for _, path := range paths {
+		if len(outermost) > 0 && isSubPath(outermost[len(outermost)-1], path) {
+			continue
+		}
+
+		outermost = append(outermost, path)
+	}
+
+	return outermost
+}
+
+// isSubPath returns true if path is parent or below it
+func isSubPath(parent, path string) bool {
+	return path == parent || strings.HasPrefix(path, strings.TrimSuffix(parent, "/")+"/")
+}
+
+// copyParents creates the missing parent directories of path below dstRoot with the modes and
+// owners of the parent directories below srcRoot
+func copyParents(srcRoot, dstRoot, path string) error {
+	parents := []string{}
+	for parent := filepath.Dir(path); parent != "/"; parent = filepath.Dir(parent) {
+		parents = append([]string{parent}, parents...)
+	}
+
+	for _, parent := range parents {
+		dst := filepath.Join(dstRoot, parent)
+		if _, err := os.Lstat(dst); err == nil {
+			continue
+		}
+
+		src := filepath.Join(srcRoot, parent)
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+
+		err = copyEntry(src, dst, info)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyTree copies src to dst and keeps the modes, owners and modification times. Directories are
+// merged, other existing files are replaced and reported to conflict if their content differs.
+func copyTree(src, dst string, conflict func(path string)) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, relPath)
+		existing, err := os.Lstat(target)
+		if err == nil && !(existing.IsDir() && info.IsDir()) {
+			if conflict != nil && !sameFileContent(target, existing, path, info) {
+				conflict(target)
+			}
+
+			err = os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+		}
+
+		return copyEntry(path, target, info)
+	})
+}
+
+// copyEntry copies a single directory, file or symlink. Sockets, pipes and devices are skipped.
+func copyEntry(src, dst string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		err := os.Mkdir(dst, 0700)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+
+		err = os.Symlink(link, dst)
+		if err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		err := copyFile(src, dst)
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		err := os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+		if err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	err := os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// sameFileContent returns true if both files are regular files or symlinks with the same content
+func sameFileContent(path string, info os.FileInfo, otherPath string, otherInfo os.FileInfo) bool {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0 && otherInfo.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		otherLink, otherErr := os.Readlink(otherPath)
+		return err == nil && otherErr == nil && link == otherLink
+	case info.Mode().IsRegular() && otherInfo.Mode().IsRegular():
+		if info.Size() != otherInfo.Size() {
+			return false
+		}
+
+		return sameContent(path, otherPath)
+	}
+
+	return false
+}
+
+func sameContent(path, otherPath string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	otherFile, err := os.Open(otherPath)
+	if err != nil {
+		return false
+	}
+	defer otherFile.Close()
+
+	buf := make([]byte, 32*1024)
+	otherBuf := make([]byte, 32*1024)
+	for {
+		n, err := io.ReadFull(file, buf)
+		otherN, otherErr := io.ReadFull(otherFile, otherBuf)
+		if n != otherN || !bytes.Equal(buf[:n], otherBuf[:otherN]) {
+			return false
+		} else if err != nil || otherErr != nil {
+			return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+		}
+	}
+}
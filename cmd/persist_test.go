@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidatePersistPath(t *testing.T) {
+	tests := map[string]bool{
+		"/home/*/.ssh":        true,
+		"/root/.bash_history": true,
+		"home/.ssh":           false,
+		"/":                   false,
+		"/.dockerless/cache":  false,
+		"/home/[a":            false,
+	}
+	for path, valid := range tests {
+		err := validatePersistPath(path)
+		if valid != (err == nil) {
+			t.Errorf("%s: expected valid %v, got %v", path, valid, err)
+		}
+	}
+}
+
+func TestOutermostPaths(t *testing.T) {
+	got := outermostPaths([]string{"/home/dev/.ssh/id_rsa", "/root", "/home/dev/.ssh", "/root", "/home/dev/.sshd"})
+	want := []string{"/home/dev/.ssh", "/home/dev/.sshd", "/root"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestPersistPaths(t *testing.T) {
+	root := t.TempDir()
+	PersistDir = filepath.Join(t.TempDir(), "persist")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	ssh := filepath.Join(root, "home", "dev", ".ssh")
+	writeFile(t, filepath.Join(ssh, "id_rsa"), "key")
+	writeFile(t, filepath.Join(ssh, "known_hosts"), "hosts")
+	writeFile(t, filepath.Join(root, "home", "dev", ".bash_history"), "ls")
+	if err := os.Chmod(filepath.Join(ssh, "id_rsa"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(ssh, "id_rsa"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("id_rsa", filepath.Join(ssh, "default")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := persistPaths([]string{filepath.Join(root, "home", "*", ".ssh"), filepath.Join(root, "home", "*", ".bash_history")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a build that fails after deleting the filesystem keeps the persisted paths for the next one
+	if err := os.RemoveAll(filepath.Join(root, "home")); err != nil {
+		t.Fatal(err)
+	}
+	err = persistPaths([]string{filepath.Join(root, "home", "*", ".ssh")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new image contains its own files in the persisted paths
+	writeFile(t, filepath.Join(ssh, "known_hosts"), "image hosts")
+	writeFile(t, filepath.Join(ssh, "config"), "image config")
+
+	conflicts, err := restorePersistedPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conflicts, []string{filepath.Join(ssh, "known_hosts")}) {
+		t.Fatalf("expected known_hosts to conflict, got %v", conflicts)
+	}
+
+	for path, content := range map[string]string{
+		filepath.Join(ssh, "id_rsa"):                        "key",
+		filepath.Join(ssh, "known_hosts"):                   "hosts",
+		filepath.Join(ssh, "config"):                        "image config",
+		filepath.Join(root, "home", "dev", ".bash_history"): "ls",
+	} {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != content {
+			t.Fatalf("%s: expected %q, got %q", path, content, got)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(ssh, "id_rsa"))
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 || !info.ModTime().Equal(modTime) {
+		t.Fatalf("expected mode 0600 and mtime %s, got %s and %s", modTime, info.Mode(), info.ModTime())
+	}
+	link, err := os.Readlink(filepath.Join(ssh, "default"))
+	if err != nil || link != "id_rsa" {
+		t.Fatalf("expected symlink to id_rsa, got %s, %v", link, err)
+	}
+	if _, err := os.Stat(PersistDir); !os.IsNotExist(err) {
+		t.Fatalf("expected persist dir to be removed, got %v", err)
+	}
+
+	conflicts, err = restorePersistedPaths()
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("expected nothing to restore, got %v, %v", conflicts, err)
+	}
+}
+
+func TestSameFileContent(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a"), "content")
+	writeFile(t, filepath.Join(dir, "b"), "content")
+	writeFile(t, filepath.Join(dir, "c"), "changed")
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, other string
+		want        bool
+	}{
+		{path: "a", other: "b", want: true},
+		{path: "a", other: "c"},
+		{path: "a", other: "link"},
+		{path: "link", other: "link", want: true},
+	}
+	for _, test := range tests {
+		path, other := filepath.Join(dir, test.path), filepath.Join(dir, test.other)
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherInfo, err := os.Lstat(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := sameFileContent(path, info, other, otherInfo); got != test.want {
+			t.Errorf("%s and %s: expected %v, got %v", test.path, test.other, test.want, got)
+		}
+	}
+}
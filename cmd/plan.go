@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/commands"
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/executor"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+// builtinBuildArgs are allowed as build args without being declared in the Dockerfile
+var builtinBuildArgs = map[string]bool{
+	"HTTP_PROXY":  true,
+	"http_proxy":  true,
+	"HTTPS_PROXY": true,
+	"https_proxy": true,
+	"FTP_PROXY":   true,
+	"ftp_proxy":   true,
+	"NO_PROXY":    true,
+	"no_proxy":    true,
+	"ALL_PROXY":   true,
+	"all_proxy":   true,
+}
+
+// PlanError is returned if the build could not be planned. Nothing was
+// changed on the filesystem when this error is returned.
+type PlanError struct {
+	Err   error
+	Phase string
+}
+
+func (e *PlanError) Error() string {
+	return fmt.Sprintf("plan build (%s): %v", e.Phase, e.Err)
+}
+
+func (e *PlanError) Unwrap() error {
+	return e.Err
+}
+
+// BuildPlan describes what a build would do
+type BuildPlan struct {
+	Stages                 []PlannedStage    `json:"stages"`
+	BaseImages             map[string]string `json:"baseImages,omitempty"`
+	CrossStageDependencies map[int][]string  `json:"crossStageDependencies,omitempty"`
+	UnusedBuildArgs        []string          `json:"unusedBuildArgs,omitempty"`
+	DeclaredBuildArgs      []string          `json:"declaredBuildArgs,omitempty"`
+	Config                 v1.Config         `json:"config"`
+}
+
+// PlannedStage is a single stage of the build plan
+type PlannedStage struct {
+	Name      string   `json:"name,omitempty"`
+	BaseImage string   `json:"baseImage"`
+	Commands  []string `json:"commands,omitempty"`
+	Index     int      `json:"index"`
+	BaseStage int      `json:"baseStage"`
+	Final     bool     `json:"final,omitempty"`
+}
+
+// planBuild parses the Dockerfile and resolves everything that is needed to build it, without touching the filesystem
+func planBuild(opts *config.KanikoOptions, images *baseImageResolver) (*BuildPlan, error) {
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	if err != nil {
+		return nil, &PlanError{Phase: "parse dockerfile", Err: err}
+	}
+
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	if err != nil {
+		return nil, &PlanError{Phase: "resolve stages", Err: err}
+	}
+	stageNameToIdx := executor.ResolveCrossStageInstructions(kanikoStages)
+
+	fileContext, err := util.NewFileContextFromDockerfile(opts.DockerfilePath, opts.SrcContext)
+	if err != nil {
+		return nil, &PlanError{Phase: "create file context", Err: err}
+	}
+
+	crossStageDependencies, err := executor.CalculateDependencies(kanikoStages, opts, stageNameToIdx)
+	if err != nil {
+		return nil, &PlanError{Phase: "calculate dependencies", Err: err}
+	}
+
+	plan := &BuildPlan{
+		BaseImages:             map[string]string{},
+		CrossStageDependencies: crossStageDependencies,
+		UnusedBuildArgs:        unusedBuildArgs(opts.BuildArgs, kanikoStages),
+		DeclaredBuildArgs:      declaredBuildArgs(kanikoStages),
+	}
+	stageConfigs := map[int]v1.Config{}
+	for _, stage := range kanikoStages {
+		imageConfig, err := stageBaseConfig(stage, images, plan.BaseImages, stageConfigs)
+		if err != nil {
+			return nil, &PlanError{Phase: "retrieve base image", Err: err}
+		}
+
+		plannedStage := PlannedStage{
+			Name:      stage.Name,
+			BaseImage: stage.BaseName,
+			Index:     stage.Index,
+			BaseStage: stage.BaseImageIndex,
+			Final:     stage.Final,
+		}
+
+		args := dockerfile.NewBuildArgs(opts.BuildArgs)
+		args.AddMetaArgs(stage.MetaArgs)
+		for _, command := range stage.Commands {
+			err = applyMetadataCommand(command, imageConfig, args, fileContext)
+			if err != nil {
+				return nil, &PlanError{Phase: "apply " + command.Name(), Err: err}
+			}
+
+			plannedStage.Commands = append(plannedStage.Commands, fmt.Sprint(command))
+		}
+
+		stageConfigs[stage.Index] = *imageConfig
+		plan.Stages = append(plan.Stages, plannedStage)
+		if stage.Final {
+			plan.Config = *imageConfig
+		}
+	}
+
+	return plan, nil
+}
+
+// applyMetadataCommand applies commands that only change the image config. Commands that
+// would touch the filesystem are either skipped or only applied to the config.
+func applyMetadataCommand(command instructions.Command, imageConfig *v1.Config, args *dockerfile.BuildArgs, fileContext util.FileContext) error {
+	replacementEnvs := args.ReplacementEnvs(imageConfig.Env)
+	switch c := command.(type) {
+	case *instructions.WorkdirCommand:
+		workingDir, err := util.ResolveEnvironmentReplacement(c.Path, replacementEnvs, true)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(workingDir) {
+			workingDir = filepath.Join("/", imageConfig.WorkingDir, workingDir)
+		}
+
+		imageConfig.WorkingDir = workingDir
+		return nil
+	case *instructions.VolumeCommand:
+		volumes, err := util.ResolveEnvironmentReplacementList(c.Volumes, replacementEnvs, true)
+		if err != nil {
+			return err
+		}
+		if imageConfig.Volumes == nil {
+			imageConfig.Volumes = map[string]struct{}{}
+		}
+		for _, volume := range volumes {
+			imageConfig.Volumes[volume] = struct{}{}
+		}
+
+		return nil
+	case *instructions.EnvCommand, *instructions.ArgCommand, *instructions.LabelCommand,
+		*instructions.UserCommand, *instructions.CmdCommand, *instructions.EntrypointCommand,
+		*instructions.ExposeCommand, *instructions.StopSignalCommand, *instructions.ShellCommand,
+		*instructions.HealthCheckCommand, *instructions.OnbuildCommand:
+		dockerCommand, err := commands.GetCommand(command, fileContext, true, true, true)
+		if err != nil {
+			return err
+		}
+
+		return dockerCommand.ExecuteCommand(imageConfig, args)
+	default:
+		return nil
+	}
+}
+
+func printPlan(plan *BuildPlan) error {
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal build plan: %w", err)
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+// unusedBuildArgs returns all build args that are not declared by any ARG in the stages we build
+func unusedBuildArgs(buildArgs []string, stages []config.KanikoStage) []string {
+	declared := map[string]bool{}
+	for _, name := range declaredBuildArgs(stages) {
+		declared[name] = true
+	}
+
+	unused := []string{}
+	for _, buildArg := range buildArgs {
+		key := strings.SplitN(buildArg, "=", 2)[0]
+		if !declared[key] && !builtinBuildArgs[key] {
+			unused = append(unused, key)
+			declared[key] = true
+		}
+	}
+	sort.Strings(unused)
+
+	return unused
+}
+
+// declaredBuildArgs returns the names of all ARGs declared in the Dockerfile, sorted by name
+func declaredBuildArgs(stages []config.KanikoStage) []string {
+	declared := map[string]bool{}
+	for _, stage := range stages {
+		for _, metaArg := range stage.MetaArgs {
+			for _, arg := range metaArg.Args {
+				declared[arg.Key] = true
+			}
+		}
+		for _, command := range stage.Commands {
+			argCommand, ok := command.(*instructions.ArgCommand)
+			if !ok {
+				continue
+			}
+
+			for _, arg := range argCommand.Args {
+				declared[arg.Key] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(declared))
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+)
+
+func TestPlanBuild(t *testing.T) {
+	contextDir := t.TempDir()
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	writeFile(t, dockerfile, `ARG VERSION=1
+FROM scratch AS base
+ARG NAME
+ENV NAME=$NAME
+WORKDIR app
+
+FROM base AS dev
+ARG VERSION
+USER 1000
+LABEL version=$VERSION
+ENTRYPOINT ["/bin/app"]
+
+FROM scratch AS unused
+`)
+
+	opts := &config.KanikoOptions{
+		DockerfilePath:   dockerfile,
+		SrcContext:       contextDir,
+		Target:           "dev",
+		BuildArgs:        []string{"NAME=dockerless", "OTHER=1", "HTTP_PROXY=http://proxy"},
+		SkipUnusedStages: true,
+	}
+	plan, err := planBuild(opts, newBaseImageResolver(opts, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Stages) != 2 || plan.Stages[0].Name != "base" || !plan.Stages[1].Final {
+		t.Fatalf("expected stages base and dev, got %+v", plan.Stages)
+	}
+	if !reflect.DeepEqual(plan.UnusedBuildArgs, []string{"OTHER"}) {
+		t.Fatalf("expected unused build arg OTHER, got %v", plan.UnusedBuildArgs)
+	}
+	if !reflect.DeepEqual(plan.DeclaredBuildArgs, []string{"NAME", "VERSION"}) {
+		t.Fatalf("expected declared build args NAME and VERSION, got %v", plan.DeclaredBuildArgs)
+	}
+	if plan.Config.User != "1000" || plan.Config.WorkingDir != "/app" || plan.Config.Labels["version"] != "1" {
+		t.Fatalf("unexpected config %+v", plan.Config)
+	}
+	if !reflect.DeepEqual(plan.Config.Entrypoint, []string{"/bin/app"}) {
+		t.Fatalf("expected entrypoint /bin/app, got %v", plan.Config.Entrypoint)
+	}
+}
+
+func TestPlanBuildErrors(t *testing.T) {
+	tests := map[string]struct {
+		dockerfile string
+		target     string
+	}{
+		"invalid instruction": {dockerfile: "FROM scratch\nINVALID command\n"},
+		"missing target":      {dockerfile: "FROM scratch AS base\n", target: "missing"},
+		"no stages":           {dockerfile: "# nothing to build\n"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+			writeFile(t, dockerfile, test.dockerfile)
+
+			opts := &config.KanikoOptions{DockerfilePath: dockerfile, SrcContext: filepath.Dir(dockerfile), Target: test.target}
+			_, err := planBuild(opts, newBaseImageResolver(opts, nil))
+			planErr := &PlanError{}
+			if !errors.As(err, &planErr) {
+				t.Fatalf("expected plan error, got %v", err)
+			}
+		})
+	}
+}
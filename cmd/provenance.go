@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// Version is the dockerless version, it is set at build time
+var Version = "dev"
+
+// provenance labels added to the built image
+const (
+	createdLabel          = "org.opencontainers.image.created"
+	revisionLabel         = "org.opencontainers.image.revision"
+	dockerfileLabel       = "sh.loft.dockerless.dockerfile"
+	dockerfileDigestLabel = "sh.loft.dockerless.dockerfile.digest"
+	targetLabel           = "sh.loft.dockerless.target"
+	versionLabel          = "sh.loft.dockerless.version"
+)
+
+var gitCommitRegEx = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// parseLabels validates labels of the form key=value
+func parseLabels(labels []string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, label := range labels {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --label %s: expected key=value", label)
+		}
+
+		parsed[key] = value
+	}
+
+	return parsed, nil
+}
+
+// digestDockerfile returns the digest of a local or remote Dockerfile
+func digestDockerfile(ctx context.Context, dockerfile string) (string, error) {
+	dockerfileContent, err := readDockerfile(ctx, dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("read dockerfile: %w", err)
+	}
+
+	return "sha256:" + hashString(string(dockerfileContent)), nil
+}
+
+// addProvenanceLabels adds labels to the final image that describe where it was built from. They
+// replace labels inherited from the base image, but never the labels set with --label.
+func (cmd *BuildCmd) addProvenanceLabels(image v1.Image, dockerfileDigest, contextDir string, buildTime time.Time) (v1.Image, error) {
+	provenance := map[string]string{
+		createdLabel:          buildTime.UTC().Format(time.RFC3339),
+		dockerfileLabel:       cmd.Dockerfile,
+		dockerfileDigestLabel: dockerfileDigest,
+		versionLabel:          Version,
+	}
+	if cmd.Target != "" {
+		provenance[targetLabel] = cmd.Target
+	}
+	if commit := readGitCommit(contextDir); commit != "" {
+		provenance[revisionLabel] = commit
+	}
+
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get image config: %w", err)
+	}
+
+	imageConfig := *configFile.Config.DeepCopy()
+	if imageConfig.Labels == nil {
+		imageConfig.Labels = map[string]string{}
+	}
+	for key, value := range provenance {
+		if _, ok := cmd.labels[key]; !ok {
+			imageConfig.Labels[key] = value
+		}
+	}
+
+	image, err = mutate.Config(image, imageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("add provenance labels: %w", err)
+	}
+
+	return image, nil
+}
+
+// readGitCommit returns the commit checked out in the git repository that contains dir or an empty
+// string if there is none. We read the repository ourselves, as git might not be installed.
+func readGitCommit(dir string) string {
+	gitDir := findGitDir(dir)
+	if gitDir == "" {
+		return ""
+	}
+
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+
+	ref, isRef := strings.CutPrefix(strings.TrimSpace(string(head)), "ref: ")
+	if !isRef {
+		return validGitCommit(ref)
+	}
+
+	// worktrees keep their refs in the common dir of the repository
+	commonDir := gitDir
+	if out, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir = resolvePath(gitDir, strings.TrimSpace(string(out)))
+	}
+	for _, refsDir := range []string{gitDir, commonDir} {
+		out, err := os.ReadFile(filepath.Join(refsDir, filepath.FromSlash(ref)))
+		if err == nil {
+			return validGitCommit(strings.TrimSpace(string(out)))
+		}
+	}
+
+	return readPackedRef(commonDir, ref)
+}
+
+// findGitDir returns the .git directory of the repository that contains dir
+func findGitDir(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		info, err := os.Stat(gitPath)
+		if err == nil && info.IsDir() {
+			return gitPath
+		} else if err == nil {
+			// worktrees and submodules use a file pointing to the git dir
+			out, err := os.ReadFile(gitPath)
+			if err != nil {
+				return ""
+			}
+
+			gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(out)), "gitdir: ")
+			if !ok {
+				return ""
+			}
+
+			return resolvePath(dir, gitDir)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func readPackedRef(gitDir, ref string) string {
+	file, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		commit, name, ok := strings.Cut(scanner.Text(), " ")
+		if ok && name == ref {
+			return validGitCommit(commit)
+		}
+	}
+
+	return ""
+}
+
+// resolvePath resolves path relative to base, unless it is absolute
+func resolvePath(base, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(base, path)
+}
+
+func validGitCommit(commit string) string {
+	if !gitCommitRegEx.MatchString(commit) {
+		return ""
+	}
+
+	return commit
+}
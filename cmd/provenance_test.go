@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels([]string{"team=platform", "empty=", "url=https://example.com?a=b"})
+	if err != nil {
+		t.Fatal(err)
+	} else if labels["team"] != "platform" || labels["empty"] != "" || labels["url"] != "https://example.com?a=b" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+
+	for _, invalid := range []string{"team", "=platform"} {
+		_, err := parseLabels([]string{invalid})
+		if err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestDigestDockerfile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("FROM alpine"))
+	}))
+	defer server.Close()
+
+	local := filepath.Join(t.TempDir(), "Dockerfile")
+	writeFile(t, local, "FROM alpine")
+
+	want := "sha256:" + hashString("FROM alpine")
+	for _, dockerfile := range []string{local, server.URL + "/Dockerfile"} {
+		got, err := digestDockerfile(context.Background(), dockerfile)
+		if err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("%s: expected %s, got %s", dockerfile, want, got)
+		}
+	}
+}
+
+func TestAddProvenanceLabels(t *testing.T) {
+	cmd := &BuildCmd{Dockerfile: ".devcontainer/Dockerfile", Target: "dev", labels: map[string]string{versionLabel: "custom"}}
+	buildTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	image, err := cmd.addProvenanceLabels(testImage(t, nil), "sha256:abc", t.TempDir(), buildTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		createdLabel:          "2026-01-02T03:04:05Z",
+		dockerfileLabel:       ".devcontainer/Dockerfile",
+		dockerfileDigestLabel: "sha256:abc",
+		targetLabel:           "dev",
+	}
+	for key, value := range want {
+		if configFile.Config.Labels[key] != value {
+			t.Errorf("expected label %s=%s, got %q", key, value, configFile.Config.Labels[key])
+		}
+	}
+	if _, ok := configFile.Config.Labels[versionLabel]; ok {
+		t.Error("expected provenance labels not to replace labels set with --label")
+	}
+	if _, ok := configFile.Config.Labels[revisionLabel]; ok {
+		t.Error("expected no revision outside of a git repository")
+	}
+}
+
+func TestReadGitCommit(t *testing.T) {
+	commit := strings.Repeat("a", 40)
+	packedCommit := strings.Repeat("b", 40)
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{name: "no repository"},
+		{name: "branch", files: map[string]string{".git/HEAD": "ref: refs/heads/main\n", ".git/refs/heads/main": commit + "\n"}, want: commit},
+		{name: "detached", files: map[string]string{".git/HEAD": commit + "\n"}, want: commit},
+		{name: "packed ref", files: map[string]string{".git/HEAD": "ref: refs/heads/main\n", ".git/packed-refs": "# pack-refs with: peeled\n" + packedCommit + " refs/heads/main\n"}, want: packedCommit},
+		{name: "invalid commit", files: map[string]string{".git/HEAD": "not a commit\n"}},
+		{
+			name: "worktree",
+			files: map[string]string{
+				".git":                                  "gitdir: repo/.git/worktrees/feature\n",
+				"repo/.git/worktrees/feature/HEAD":      "ref: refs/heads/feature\n",
+				"repo/.git/worktrees/feature/commondir": "../..\n",
+				"repo/.git/refs/heads/feature":          commit + "\n",
+			},
+			want: commit,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range test.files {
+				writeFile(t, filepath.Join(dir, name), content)
+			}
+
+			// the context might be a subdirectory of the repository
+			contextDir := filepath.Join(dir, "context")
+			err := os.MkdirAll(contextDir, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readGitCommit(contextDir); got != test.want {
+				t.Fatalf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
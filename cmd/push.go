@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/executor"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// pushOptions returns the kaniko options used to push the built image and to write the digest files
+func (cmd *BuildCmd) pushOptions(opts *config.KanikoOptions) *config.KanikoOptions {
+	pushOpts := *opts
+	pushOpts.Destinations = cmd.Destinations
+	pushOpts.NoPush = len(cmd.Destinations) == 0
+	pushOpts.DigestFile = cmd.DigestFile
+	pushOpts.ImageNameTagDigestFile = cmd.ImageNameTagDigestFile
+
+	// exports are handled by dockerless itself
+	pushOpts.OCILayoutPath = ""
+	pushOpts.TarPath = ""
+	return &pushOpts
+}
+
+func (cmd *BuildCmd) shouldPush() bool {
+	return len(cmd.Destinations) > 0 || cmd.DigestFile != "" || cmd.ImageNameTagDigestFile != ""
+}
+
+// checkPushPermissions makes sure we can push to all destinations before we start building
+func (cmd *BuildCmd) checkPushPermissions(opts *config.KanikoOptions) error {
+	if len(cmd.Destinations) == 0 {
+		return nil
+	}
+
+	err := executor.CheckPushPermissions(cmd.pushOptions(opts))
+	if err != nil {
+		return fmt.Errorf("check push permissions: %w", err)
+	}
+
+	return nil
+}
+
+// pushImage pushes the image to all destinations and writes the digest files
+func (cmd *BuildCmd) pushImage(image v1.Image, opts *config.KanikoOptions) error {
+	if !cmd.shouldPush() {
+		return nil
+	}
+
+	err := executor.DoPush(image, cmd.pushOptions(opts))
+	if err != nil {
+		return fmt.Errorf("push image: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestPushImage(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	dir := t.TempDir()
+	cmd := &BuildCmd{
+		Destinations:           []string{host + "/app:v1", host + "/app:latest"},
+		DigestFile:             filepath.Join(dir, "digest"),
+		ImageNameTagDigestFile: filepath.Join(dir, "image-names"),
+	}
+	cmd.InsecureRegistries = []string{host}
+	opts := &config.KanikoOptions{RegistryOptions: cmd.registryOptions()}
+
+	err := cmd.checkPushPermissions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := testImage(t, map[string]string{"etc/hello": "world"})
+	err = cmd.pushImage(image, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, destination := range cmd.Destinations {
+		ref, err := name.ParseReference(destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pushed, err := remote.Image(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushedDigest, err := pushed.Digest()
+		if err != nil {
+			t.Fatal(err)
+		} else if pushedDigest != digest {
+			t.Fatalf("expected %s to have digest %s, got %s", destination, digest, pushedDigest)
+		}
+	}
+
+	digestFile, err := os.ReadFile(cmd.DigestFile)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(digestFile) != digest.String() {
+		t.Fatalf("expected digest file to contain %s, got %s", digest, digestFile)
+	}
+
+	imageNames, err := os.ReadFile(cmd.ImageNameTagDigestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, destination := range cmd.Destinations {
+		if !strings.Contains(string(imageNames), destination+"@"+digest.String()) {
+			t.Fatalf("expected %s@%s in image names, got %s", destination, digest, imageNames)
+		}
+	}
+	if !cmd.outputsExist() {
+		t.Fatal("expected digest files to exist after the push")
+	}
+}
+
+func TestPushOutputs(t *testing.T) {
+	cmd := &BuildCmd{Destinations: []string{"registry.example.com/app:v1"}}
+	before := cmd.outputs()
+
+	cmd.Destinations = append(cmd.Destinations, "registry.example.com/app:v2")
+	if strings.Join(before, ",") == strings.Join(cmd.outputs(), ",") {
+		t.Fatal("expected a new destination to change the outputs")
+	}
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/spf13/pflag"
+)
+
+// RegistryFlags configure how dockerless talks to registries
+type RegistryFlags struct {
+	RegistryAuthFile            string
+	RegistryMirrors             []string
+	InsecureRegistries          []string
+	SkipTLSVerifyRegistries     []string
+	RegistryCertificates        []string
+	RegistryClientCertificates  []string
+	RegistryAuths               []string
+	RegistryTokens              []string
+	Insecure                    bool
+	SkipDefaultRegistryFallback bool
+}
+
+func (f *RegistryFlags) addFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&f.Insecure, "insecure", false, "If true will use plain http and skip tls verification for all registries.")
+	flags.StringArrayVar(&f.RegistryMirrors, "registry-mirror", []string{}, "Registry mirror to pull docker hub images from. Can be specified multiple times.")
+	flags.BoolVar(&f.SkipDefaultRegistryFallback, "skip-default-registry-fallback", false, "If true will fail instead of pulling from docker hub if no registry mirror has the image.")
+	flags.StringArrayVar(&f.InsecureRegistries, "insecure-registry", []string{}, "Registry to access via plain http. Can be specified multiple times.")
+	flags.StringArrayVar(&f.SkipTLSVerifyRegistries, "skip-tls-verify-registry", []string{}, "Registry to skip tls verification for. Can be specified multiple times.")
+	flags.StringArrayVar(&f.RegistryCertificates, "registry-certificate", []string{}, "CA bundle to verify a registry with, e.g. my.registry.url=/path/to/ca.crt. Can be specified multiple times.")
+	flags.StringArrayVar(&f.RegistryClientCertificates, "registry-client-cert", []string{}, "Client certificate and key for mutual tls with a registry, e.g. my.registry.url=/path/to/client.crt,/path/to/client.key. Can be specified multiple times.")
+	flags.StringVar(&f.RegistryAuthFile, "registry-auth-file", "", "Docker config.json with registry credentials, e.g. a mounted secret.")
+	flags.StringArrayVar(&f.RegistryAuths, "registry-auth", []string{}, "Credentials for a registry, e.g. my.registry.url=user:password. Can be specified multiple times.")
+	flags.StringArrayVar(&f.RegistryTokens, "registry-token", []string{}, "Bearer token for a registry, e.g. my.registry.url=token. Can be specified multiple times.")
+}
+
+// parseRegistryOptions fills the registry options from the environment and validates them
+func (f *RegistryFlags) parseRegistryOptions() error {
+	if !f.Insecure {
+		if insecure := os.Getenv("DOCKERLESS_INSECURE"); insecure != "" {
+			parsed, err := strconv.ParseBool(insecure)
+			if err != nil {
+				return fmt.Errorf("invalid DOCKERLESS_INSECURE %s: %w", insecure, err)
+			}
+
+			f.Insecure = parsed
+		}
+	}
+
+	for env, target := range map[string]*[]string{
+		"DOCKERLESS_REGISTRY_MIRRORS":             &f.RegistryMirrors,
+		"DOCKERLESS_INSECURE_REGISTRIES":          &f.InsecureRegistries,
+		"DOCKERLESS_SKIP_TLS_VERIFY_REGISTRIES":   &f.SkipTLSVerifyRegistries,
+		"DOCKERLESS_REGISTRY_CERTIFICATES":        &f.RegistryCertificates,
+		"DOCKERLESS_REGISTRY_CLIENT_CERTIFICATES": &f.RegistryClientCertificates,
+	} {
+		values, err := jsonListFromEnv(env)
+		if err != nil {
+			return err
+		}
+
+		// flags come last, so they win over the environment
+		*target = append(values, *target...)
+	}
+
+	// make sure the certificates exist before we delete anything
+	certificates, err := parseRegistryMap(f.RegistryCertificates, "--registry-certificate")
+	if err != nil {
+		return err
+	}
+	for registry, certificate := range certificates {
+		if !fileExists(certificate) {
+			return fmt.Errorf("certificate %s for registry %s does not exist", certificate, registry)
+		}
+	}
+
+	clientCertificates, err := parseRegistryMap(f.RegistryClientCertificates, "--registry-client-cert")
+	if err != nil {
+		return err
+	}
+	for registry, clientCertificate := range clientCertificates {
+		certFiles := strings.Split(clientCertificate, ",")
+		if len(certFiles) != 2 {
+			return fmt.Errorf("invalid client certificate %s for registry %s: expected /path/to/cert,/path/to/key", clientCertificate, registry)
+		}
+
+		for _, certFile := range certFiles {
+			if !fileExists(certFile) {
+				return fmt.Errorf("client certificate %s for registry %s does not exist", certFile, registry)
+			}
+		}
+	}
+
+	// kaniko adds client certificates to the tls config of the default transport, which is nil by default
+	if len(clientCertificates) > 0 {
+		transport, ok := http.DefaultTransport.(*http.Transport)
+		if ok && transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+	}
+
+	return f.configureRegistryAuth()
+}
+
+// registryOptions returns the kaniko registry options. TLS is verified unless explicitly disabled.
+func (f *RegistryFlags) registryOptions() config.RegistryOptions {
+	// the values were already validated by parseRegistryOptions
+	certificates, _ := parseRegistryMap(f.RegistryCertificates, "--registry-certificate")
+	clientCertificates, _ := parseRegistryMap(f.RegistryClientCertificates, "--registry-client-cert")
+	return config.RegistryOptions{
+		RegistryMirrors:              f.RegistryMirrors,
+		InsecureRegistries:           f.InsecureRegistries,
+		SkipTLSVerifyRegistries:      f.SkipTLSVerifyRegistries,
+		RegistriesCertificates:       certificates,
+		RegistriesClientCertificates: clientCertificates,
+		SkipDefaultRegistryFallback:  f.SkipDefaultRegistryFallback,
+		Insecure:                     f.Insecure,
+		InsecurePull:                 f.Insecure,
+		SkipTLSVerify:                f.Insecure,
+		SkipTLSVerifyPull:            f.Insecure,
+	}
+}
+
+// parseRegistryMap parses a list of registry=value pairs
+func parseRegistryMap(values []string, flag string) (map[string]string, error) {
+	registryMap := map[string]string{}
+	for _, value := range values {
+		splitted := strings.SplitN(value, "=", 2)
+		if len(splitted) != 2 || splitted[0] == "" || splitted[1] == "" {
+			return nil, fmt.Errorf("invalid %s %s: expected registry=value", flag, value)
+		}
+
+		registryMap[splitted[0]] = splitted[1]
+	}
+
+	return registryMap, nil
+}
+
+// jsonListFromEnv parses the environment variable env as json string array
+func jsonListFromEnv(env string) ([]string, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil, nil
+	}
+
+	values := []string{}
+	err := json.Unmarshal([]byte(value), &values)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s as json string array: %w", env, err)
+	}
+
+	return values, nil
+}
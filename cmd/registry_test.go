@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJSONListFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "empty list", value: `[]`, want: []string{}},
+		{name: "list", value: `["mirror.gcr.io", "my.registry:5000"]`, want: []string{"mirror.gcr.io", "my.registry:5000"}},
+		{name: "plain string", value: `mirror.gcr.io`, wantErr: true},
+		{name: "comma separated", value: `mirror.gcr.io,my.registry`, wantErr: true},
+		{name: "numbers", value: `[1, 2]`, wantErr: true},
+		{name: "object", value: `{"mirror": "mirror.gcr.io"}`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DOCKERLESS_TEST_LIST", test.value)
+
+			got, err := jsonListFromEnv("DOCKERLESS_TEST_LIST")
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %#v, got %#v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseRegistryMap(t *testing.T) {
+	got, err := parseRegistryMap([]string{"my.registry=/certs/ca.crt", "other.registry:5000=/certs/a=b.crt"}, "--registry-certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"my.registry": "/certs/ca.crt", "other.registry:5000": "/certs/a=b.crt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	for _, invalid := range []string{"my.registry", "=/certs/ca.crt", "my.registry="} {
+		_, err := parseRegistryMap([]string{invalid}, "--registry-certificate")
+		if err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestParseRegistryOptions(t *testing.T) {
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.crt")
+	writeFile(t, ca, "ca")
+
+	tests := []struct {
+		name    string
+		flags   RegistryFlags
+		env     map[string]string
+		want    RegistryFlags
+		wantErr bool
+	}{
+		{
+			name: "flags come after the environment",
+			flags: RegistryFlags{
+				RegistryMirrors:      []string{"flag.mirror"},
+				RegistryCertificates: []string{"my.registry=" + ca},
+			},
+			env: map[string]string{
+				"DOCKERLESS_REGISTRY_MIRRORS":    `["env.mirror"]`,
+				"DOCKERLESS_INSECURE_REGISTRIES": `["insecure.registry"]`,
+				"DOCKERLESS_INSECURE":            "true",
+			},
+			want: RegistryFlags{
+				RegistryMirrors:      []string{"env.mirror", "flag.mirror"},
+				InsecureRegistries:   []string{"insecure.registry"},
+				RegistryCertificates: []string{"my.registry=" + ca},
+				Insecure:             true,
+			},
+		},
+		{name: "invalid insecure", env: map[string]string{"DOCKERLESS_INSECURE": "maybe"}, wantErr: true},
+		{name: "invalid list", env: map[string]string{"DOCKERLESS_REGISTRY_MIRRORS": "env.mirror"}, wantErr: true},
+		{name: "missing certificate", flags: RegistryFlags{RegistryCertificates: []string{"my.registry=" + ca + ".missing"}}, wantErr: true},
+		{name: "client certificate without key", flags: RegistryFlags{RegistryClientCertificates: []string{"my.registry=" + ca}}, wantErr: true},
+		{name: "missing client key", flags: RegistryFlags{RegistryClientCertificates: []string{"my.registry=" + ca + "," + ca + ".missing"}}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			flags := test.flags
+			err := flags.parseRegistryOptions()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(flags.RegistryMirrors, test.want.RegistryMirrors) || !reflect.DeepEqual(flags.InsecureRegistries, test.want.InsecureRegistries) || flags.Insecure != test.want.Insecure {
+				t.Fatalf("expected %+v, got %+v", test.want, flags)
+			}
+
+			opts := flags.registryOptions()
+			if opts.RegistriesCertificates["my.registry"] != ca {
+				t.Fatalf("expected certificate for my.registry, got %v", opts.RegistriesCertificates)
+			} else if !opts.SkipTLSVerify || !opts.InsecurePull {
+				t.Fatal("expected --insecure to disable tls verification")
+			}
+		})
+	}
+}
+
+func TestRegistryOptionsVerifyTLSByDefault(t *testing.T) {
+	opts := (&RegistryFlags{}).registryOptions()
+	if opts.Insecure || opts.InsecurePull || opts.SkipTLSVerify || opts.SkipTLSVerifyPull {
+		t.Fatalf("expected tls to be verified by default, got %+v", opts)
+	}
+}
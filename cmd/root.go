@@ -7,11 +7,14 @@ func NewRootCmd() *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:           "dockerless",
 		Short:         "Dockerless",
+		Version:       Version,
 		SilenceUsage:  true,
 		SilenceErrors: true,
 	}
 
 	rootCmd.AddCommand(NewBuildCmd())
 	rootCmd.AddCommand(NewStartCmd())
+	rootCmd.AddCommand(NewWarmCmd())
+	rootCmd.AddCommand(NewCacheCmd())
 	return rootCmd
 }
@@ -0,0 +1,734 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// RootFSOutput records the digests of the layers that are extracted on /
+var RootFSOutput = "/.dockerless/rootfs.json"
+
+// RootFSIndexDir keeps the file list of every recorded layer, so / can be reset to a prefix of them
+var RootFSIndexDir = "/.dockerless/rootfs"
+
+// minReusedBaseRatio is the share of the base image (by compressed size) that needs to be unchanged.
+// If less is reused, deleting the filesystem and extracting everything is cheaper than diffing it.
+const minReusedBaseRatio = 0.5
+
+// whiteoutPrefix marks files of lower layers that a layer deletes
+const whiteoutPrefix = ".wh."
+
+type rootFS struct {
+	Layers   []string  `json:"layers"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// extractedRootFS are the base image layers that are extracted on / already
+type extractedRootFS struct {
+	// indexes of the layers that can be reused
+	indexes [][]rootFSEntry
+	// changed are the files that the other layers on / replaced
+	changed map[string]bool
+	// recorded is when the layers were recorded, files changed afterwards were not built
+	recorded time.Time
+}
+
+// rootFSEntry is a file of a layer as listed in its tar header
+type rootFSEntry struct {
+	Name     string `json:"name"`
+	Type     byte   `json:"type"`
+	Mode     int64  `json:"mode,omitempty"`
+	UID      int    `json:"uid,omitempty"`
+	GID      int    `json:"gid,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	ModTime  int64  `json:"modTime,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+}
+
+// rootFSNode is a path of the filesystem a prefix of layers produces. Directories that are only
+// created implicitly as parents of other files have no entry.
+type rootFSNode struct {
+	entry    *rootFSEntry
+	layer    int
+	children map[string]*rootFSNode
+}
+
+// prepareRootFS gets / ready for the build and returns true if the build should record the layers
+// afterwards. Dockerfiles with a single stage reset / to the layers they share with the previous
+// build and only extract the remaining ones. All other builds delete the filesystem and let kaniko
+// extract the base images. The layers are only recorded after a successful build, so a failed build
+// never leaves changes behind that we do not know about.
+func prepareRootFS(opts *config.KanikoOptions, images *baseImageResolver) (bool, error) {
+	image, err := singleStageBaseImage(opts, images)
+	if err != nil {
+		return false, err
+	}
+
+	var layers []v1.Layer
+	var diffIDs []v1.Hash
+	extracted := &extractedRootFS{}
+	if image != nil {
+		configFile, err := image.ConfigFile()
+		if err != nil {
+			return false, fmt.Errorf("get base image config: %w", err)
+		}
+		layers, err = image.Layers()
+		if err != nil {
+			return false, fmt.Errorf("get base image layers: %w", err)
+		}
+		diffIDs = configFile.RootFS.DiffIDs
+		if len(diffIDs) != len(layers) {
+			return false, fmt.Errorf("base image has %d layers, but %d diff ids", len(layers), len(diffIDs))
+		}
+
+		extracted, err = reusableLayers(layers, diffIDs)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = os.Remove(RootFSOutput)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("remove recorded layers: %w", err)
+	}
+
+	if image == nil {
+		err = os.RemoveAll(RootFSIndexDir)
+		if err != nil {
+			return false, fmt.Errorf("remove layer indexes: %w", err)
+		}
+
+		err = util.DeleteFilesystem()
+		if err != nil {
+			return false, fmt.Errorf("delete filesystem: %w", err)
+		}
+
+		return false, nil
+	}
+
+	reused := len(extracted.indexes)
+	if reused > 0 {
+		reset, err := resetRootFS(layers[:reused], extracted, opts.ImageFSExtractRetry)
+		if err != nil {
+			return false, fmt.Errorf("reset filesystem: %w", err)
+		}
+
+		fmt.Printf("reusing %d of %d base image layers, reset %d paths\n", reused, len(layers), reset)
+	} else {
+		err = util.DeleteFilesystem()
+		if err != nil {
+			return false, fmt.Errorf("delete filesystem: %w", err)
+		}
+	}
+
+	for i := reused; i < len(layers); i++ {
+		err = util.Retry(func() error {
+			return extractLayer(layers[i], diffIDs[i])
+		}, opts.ImageFSExtractRetry, 1000)
+		if err != nil {
+			return false, fmt.Errorf("extract base image layer %s: %w", diffIDs[i], err)
+		}
+	}
+
+	// the base image is extracted already, so kaniko does not need to do it again
+	opts.Unpack = false
+	opts.InitialFSUnpacked = true
+	return true, nil
+}
+
+// recordRootFS records the layers of the built image, which are now extracted on /. The built layers
+// are indexed as well, so the next build knows which paths they changed.
+func recordRootFS(image v1.Image) error {
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("get image config: %w", err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		return fmt.Errorf("get image layers: %w", err)
+	}
+
+	diffIDs := configFile.RootFS.DiffIDs
+	for i, layer := range layers {
+		if i >= len(diffIDs) {
+			break
+		} else if _, err := os.Stat(layerIndexPath(diffIDs[i])); err == nil {
+			continue
+		}
+
+		err = indexLayer(layer, diffIDs[i])
+		if err != nil {
+			return fmt.Errorf("index built layer %s: %w", diffIDs[i], err)
+		}
+	}
+
+	return writeRootFS(diffIDs)
+}
+
+// singleStageBaseImage returns the base image if the build only has a single stage. kaniko deletes
+// the filesystem between stages, so there is nothing we could reuse in multi-stage builds.
+func singleStageBaseImage(opts *config.KanikoOptions, images *baseImageResolver) (v1.Image, error) {
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	if err != nil {
+		return nil, fmt.Errorf("parse dockerfile: %w", err)
+	}
+
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	if err != nil {
+		return nil, fmt.Errorf("resolve stages: %w", err)
+	} else if len(kanikoStages) != 1 || kanikoStages[0].BaseName == constants.NoBaseImage {
+		return nil, nil
+	}
+
+	image, err := images.stageImage(kanikoStages[0])
+	if err != nil {
+		return nil, fmt.Errorf("retrieve base image %s: %w", kanikoStages[0].BaseName, err)
+	}
+
+	return image, nil
+}
+
+// reusableLayers returns the layers of the base image that are extracted on / already. It returns
+// none if the layers diverge too early to be worth reusing.
+func reusableLayers(layers []v1.Layer, diffIDs []v1.Hash) (*extractedRootFS, error) {
+	extracted, err := extractedLayers(diffIDs)
+	if err != nil || len(extracted.indexes) == 0 {
+		return &extractedRootFS{}, err
+	}
+
+	reuse, err := worthReusing(layers, len(extracted.indexes))
+	if err != nil {
+		return nil, err
+	} else if !reuse {
+		fmt.Printf("extracting the base image again, because only %d of %d layers are unchanged\n", len(extracted.indexes), len(layers))
+		return &extractedRootFS{}, nil
+	}
+
+	return extracted, nil
+}
+
+// extractedLayers returns the leading layers that the previous build extracted on /, together with
+// the files the following layers of the previous build replaced. A layer can replace a file with one
+// of the same size and modification time, so these files always have to be reset. If we do not know
+// what one of the following layers changed, nothing can be reused.
+func extractedLayers(diffIDs []v1.Hash) (*extractedRootFS, error) {
+	previous, err := readRootFS()
+	if err != nil {
+		return nil, err
+	}
+
+	extracted := &extractedRootFS{changed: map[string]bool{}, recorded: previous.Recorded}
+	for i, diffID := range diffIDs {
+		if i >= len(previous.Layers) || previous.Layers[i] != diffID.String() {
+			break
+		}
+
+		index, err := readLayerIndex(diffID)
+		if err != nil {
+			break
+		}
+
+		extracted.indexes = append(extracted.indexes, index)
+	}
+
+	for _, layer := range previous.Layers[len(extracted.indexes):] {
+		diffID, err := v1.NewHash(layer)
+		if err != nil {
+			return &extractedRootFS{}, nil
+		}
+
+		index, err := readLayerIndex(diffID)
+		if err != nil {
+			return &extractedRootFS{}, nil
+		}
+
+		for _, entry := range index {
+			dir, base := filepath.Split(entry.Name)
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				extracted.changed[filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))] = true
+			} else if entry.Type != tar.TypeDir {
+				extracted.changed[entry.Name] = true
+			}
+		}
+	}
+
+	return extracted, nil
+}
+
+// worthReusing returns true if the first reused layers make up enough of the base image
+func worthReusing(layers []v1.Layer, reused int) (bool, error) {
+	var size, reusedSize int64
+	for i, layer := range layers {
+		layerSize, err := layer.Size()
+		if err != nil {
+			return false, fmt.Errorf("get base image layer size: %w", err)
+		}
+
+		size += layerSize
+		if i < reused {
+			reusedSize += layerSize
+		}
+	}
+
+	return float64(reusedSize) >= float64(size)*minReusedBaseRatio, nil
+}
+
+// resetRootFS resets / to the state after extracting layers and returns how many paths it changed.
+// Unexpected paths are removed, changed and missing paths are extracted from their layer again.
+func resetRootFS(layers []v1.Layer, extracted *extractedRootFS, retries int) (int, error) {
+	tree := newRootFSTree(extracted.indexes)
+
+	reset := 0
+	seen := map[*rootFSNode]bool{}
+	dirty := map[int]map[string]bool{}
+	err := filepath.Walk(config.RootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == config.RootDir {
+			return nil //nolint:nilerr
+		} else if util.CheckCleanedPathAgainstIgnoreList(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		name, err := filepath.Rel(config.RootDir, path)
+		if err != nil {
+			return err
+		}
+
+		node := tree.lookup(name)
+		if node != nil && !extracted.changedFile(name, info) && node.matches(tree, path, info) {
+			seen[node] = true
+			return nil
+		} else if node != nil && node.isDir() == info.IsDir() {
+			seen[node] = true
+			reset++
+			markDirty(dirty, node.layer, name)
+			return nil
+		}
+
+		// keep the directories of ignored paths, but remove everything else that does not belong here.
+		// Paths we remove although they are expected are extracted again as missing paths.
+		if info.IsDir() && containsIgnoredPath(path) {
+			seen[node] = node != nil
+			return nil
+		} else if node == nil {
+			reset++
+		}
+
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// everything we have not seen is missing
+	missingDirs := []string{}
+	tree.walk("", func(name string, node *rootFSNode) bool {
+		path := filepath.Join(config.RootDir, name)
+		if util.CheckCleanedPathAgainstIgnoreList(path) {
+			return false
+		} else if seen[node] {
+			return true
+		}
+
+		if node.entry == nil {
+			missingDirs = append(missingDirs, path)
+		} else if node.entry.Type != tar.TypeLink || !util.CheckCleanedPathAgainstIgnoreList(filepath.Join(config.RootDir, node.entry.Linkname)) {
+			reset++
+			markDirty(dirty, node.layer, name)
+		}
+
+		return true
+	})
+
+	for _, dir := range missingDirs {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for i, layer := range layers {
+		if len(dirty[i]) == 0 {
+			continue
+		}
+
+		err = util.Retry(func() error {
+			return extractLayerPaths(layer, dirty[i])
+		}, retries, 1000)
+		if err != nil {
+			return 0, fmt.Errorf("extract base image layer %d: %w", i, err)
+		}
+	}
+
+	return reset, nil
+}
+
+// changedFile returns true if a later layer replaced the file or it was changed after the layers were
+// recorded. cp -p or touch -r keep the modification time, but not the status change time.
+func (e *extractedRootFS) changedFile(name string, info os.FileInfo) bool {
+	if info.IsDir() {
+		return false
+	} else if e.changed[name] {
+		return true
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return !ok || time.Unix(stat.Ctim.Unix()).After(e.recorded)
+}
+
+func markDirty(dirty map[int]map[string]bool, layer int, name string) {
+	if dirty[layer] == nil {
+		dirty[layer] = map[string]bool{}
+	}
+
+	dirty[layer][name] = true
+}
+
+// containsIgnoredPath returns true if an ignored path is below dir
+func containsIgnoredPath(dir string) bool {
+	for _, entry := range util.IgnoreList() {
+		if util.HasFilepathPrefix(entry.Path, dir, entry.PrefixMatchOnly) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractLayer extracts a layer on / and writes its index
+func extractLayer(layer v1.Layer, diffID v1.Hash) error {
+	index := []rootFSEntry{}
+	_, err := util.GetFSFromLayers(config.RootDir, []v1.Layer{layer}, util.ExtractFunc(func(dest string, hdr *tar.Header, cleanedName string, tr io.Reader) error {
+		index = append(index, newRootFSEntry(hdr))
+		if strings.HasPrefix(filepath.Base(cleanedName), whiteoutPrefix) {
+			return nil
+		}
+
+		return util.ExtractFile(dest, hdr, cleanedName, tr)
+	}), util.IncludeWhiteout())
+	if err != nil {
+		return err
+	}
+
+	return writeLayerIndex(diffID, index)
+}
+
+// indexLayer writes the index of a layer without extracting it
+func indexLayer(layer v1.Layer, diffID v1.Hash) error {
+	r, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	index := []rootFSEntry{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		index = append(index, newRootFSEntry(hdr))
+	}
+
+	return writeLayerIndex(diffID, index)
+}
+
+// extractLayerPaths only extracts the given paths of a layer
+func extractLayerPaths(layer v1.Layer, names map[string]bool) error {
+	r, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := layerPath(hdr.Name)
+		if !names[name] {
+			continue
+		}
+
+		err = util.ExtractFile(config.RootDir, hdr, name, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func newRootFSEntry(hdr *tar.Header) rootFSEntry {
+	entry := rootFSEntry{
+		Name:     layerPath(hdr.Name),
+		Type:     hdr.Typeflag,
+		Mode:     hdr.Mode,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Size:     hdr.Size,
+		Linkname: hdr.Linkname,
+	}
+	if !hdr.ModTime.IsZero() {
+		entry.ModTime = hdr.ModTime.Unix()
+	}
+
+	return entry
+}
+
+// layerPath cleans the name of a file in a layer the way kaniko does when extracting it
+func layerPath(name string) string {
+	return strings.TrimPrefix(filepath.Clean(name), "/")
+}
+
+// newRootFSTree replays the indexes of the layers the way kaniko extracts them
+func newRootFSTree(indexes [][]rootFSEntry) *rootFSNode {
+	tree := &rootFSNode{}
+	for layer, index := range indexes {
+		for i := range index {
+			entry := &index[i]
+			dir, base := filepath.Split(entry.Name)
+			switch {
+			case strings.HasPrefix(base, whiteoutPrefix):
+				tree.remove(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			case entry.Type == tar.TypeReg || entry.Type == tar.TypeDir || entry.Type == tar.TypeLink || entry.Type == tar.TypeSymlink:
+				tree.insert(entry, layer)
+			}
+		}
+	}
+
+	return tree
+}
+
+func (n *rootFSNode) insert(entry *rootFSEntry, layer int) {
+	if entry.Name == "." || entry.Name == ".." || strings.HasPrefix(entry.Name, "../") {
+		return
+	}
+
+	parts := strings.Split(entry.Name, "/")
+	node := n
+	for _, part := range parts[:len(parts)-1] {
+		child := node.children[part]
+		if child == nil {
+			child = &rootFSNode{layer: layer}
+			node.addChild(part, child)
+		}
+
+		node = child
+	}
+
+	// files replace everything that was at their path, directories are merged
+	last := parts[len(parts)-1]
+	existing := node.children[last]
+	if existing != nil && existing.isDir() && entry.Type == tar.TypeDir {
+		existing.entry = entry
+		existing.layer = layer
+		return
+	}
+
+	node.addChild(last, &rootFSNode{entry: entry, layer: layer})
+}
+
+func (n *rootFSNode) addChild(name string, child *rootFSNode) {
+	if n.children == nil {
+		n.children = map[string]*rootFSNode{}
+	}
+
+	n.children[name] = child
+}
+
+func (n *rootFSNode) remove(name string) {
+	parent := n.lookup(filepath.Dir(name))
+	if parent != nil {
+		delete(parent.children, filepath.Base(name))
+	}
+}
+
+func (n *rootFSNode) lookup(name string) *rootFSNode {
+	if name == "." {
+		return n
+	}
+
+	node := n
+	for _, part := range strings.Split(name, "/") {
+		node = node.children[part]
+		if node == nil {
+			return nil
+		}
+	}
+
+	return node
+}
+
+// walk calls fn for every path below n, parents first. Children are skipped if fn returns false.
+func (n *rootFSNode) walk(name string, fn func(name string, node *rootFSNode) bool) {
+	for childName, child := range n.children {
+		childPath := filepath.Join(name, childName)
+		if fn(childPath, child) {
+			child.walk(childPath, fn)
+		}
+	}
+}
+
+func (n *rootFSNode) isDir() bool {
+	return n.entry == nil || n.entry.Type == tar.TypeDir
+}
+
+// matches does a quick check if path is still the way the layer extracted it. Like make, we trust
+// the size and modification time of regular files instead of comparing their content.
+func (n *rootFSNode) matches(tree *rootFSNode, path string, info os.FileInfo) bool {
+	if n.isDir() {
+		return info.IsDir()
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if n.entry.Type != tar.TypeSymlink && ok && (int(stat.Uid) != n.entry.UID || int(stat.Gid) != n.entry.GID) {
+		return false
+	}
+
+	switch n.entry.Type {
+	case tar.TypeSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+
+		link, err := os.Readlink(path)
+		return err == nil && link == n.entry.Linkname
+	case tar.TypeLink:
+		if !info.Mode().IsRegular() {
+			return false
+		}
+
+		// a hard link only shares the file with its target until a later layer replaces the target
+		target := tree.lookup(layerPath(n.entry.Linkname))
+		if target == nil || target.layer != n.layer {
+			return true
+		}
+
+		targetInfo, err := os.Lstat(filepath.Join(config.RootDir, n.entry.Linkname))
+		return err == nil && os.SameFile(info, targetInfo)
+	default:
+		mode := (&tar.Header{Mode: n.entry.Mode}).FileInfo().Mode()
+		permissions := os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+		return info.Mode().IsRegular() &&
+			info.Size() == n.entry.Size &&
+			info.ModTime().Unix() == n.entry.ModTime &&
+			info.Mode()&permissions == mode&permissions
+	}
+}
+
+func readRootFS() (*rootFS, error) {
+	out, err := os.ReadFile(RootFSOutput)
+	if errors.Is(err, os.ErrNotExist) {
+		return &rootFS{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read recorded layers: %w", err)
+	}
+
+	recorded := &rootFS{}
+	err = json.Unmarshal(out, recorded)
+	if err != nil {
+		return nil, fmt.Errorf("parse recorded layers: %w", err)
+	}
+
+	return recorded, nil
+}
+
+// writeRootFS records the layers and removes the indexes of all other layers
+func writeRootFS(diffIDs []v1.Hash) error {
+	recorded := &rootFS{Layers: []string{}, Recorded: time.Now()}
+	keep := map[string]bool{}
+	for _, diffID := range diffIDs {
+		recorded.Layers = append(recorded.Layers, diffID.String())
+		keep[layerIndexPath(diffID)] = true
+	}
+
+	out, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+
+	err = writeStateFile(RootFSOutput, out)
+	if err != nil {
+		return fmt.Errorf("record layers: %w", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(RootFSIndexDir, "*.json"))
+	for _, file := range files {
+		if !keep[file] {
+			_ = os.Remove(file)
+		}
+	}
+
+	return nil
+}
+
+func readLayerIndex(diffID v1.Hash) ([]rootFSEntry, error) {
+	out, err := os.ReadFile(layerIndexPath(diffID))
+	if err != nil {
+		return nil, err
+	}
+
+	index := []rootFSEntry{}
+	err = json.Unmarshal(out, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func writeLayerIndex(diffID v1.Hash, index []rootFSEntry) error {
+	out, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(RootFSIndexDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = writeStateFile(layerIndexPath(diffID), out)
+	if err != nil {
+		return fmt.Errorf("write index of layer %s: %w", diffID, err)
+	}
+
+	return nil
+}
+
+func layerIndexPath(diffID v1.Hash) string {
+	return filepath.Join(RootFSIndexDir, diffID.Algorithm+"-"+diffID.Hex+".json")
+}
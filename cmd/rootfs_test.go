@@ -0,0 +1,401 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+var testModTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestNewRootFSTree(t *testing.T) {
+	tests := []struct {
+		name    string
+		indexes [][]rootFSEntry
+		want    []string
+	}{
+		{
+			name: "whiteout removes a file",
+			indexes: [][]rootFSEntry{
+				{{Name: "etc", Type: tar.TypeDir}, {Name: "etc/a", Type: tar.TypeReg}, {Name: "etc/b", Type: tar.TypeReg}},
+				{{Name: "etc/.wh.a", Type: tar.TypeReg}},
+			},
+			want: []string{"etc 0", "etc/b 0"},
+		},
+		{
+			name: "whiteout removes a directory",
+			indexes: [][]rootFSEntry{
+				{{Name: "usr/share/doc/a", Type: tar.TypeReg}, {Name: "usr/bin/tool", Type: tar.TypeReg}},
+				{{Name: "usr/share/.wh.doc", Type: tar.TypeReg}},
+			},
+			want: []string{"usr 0", "usr/bin 0", "usr/bin/tool 0", "usr/share 0"},
+		},
+		{
+			name: "directories are merged",
+			indexes: [][]rootFSEntry{
+				{{Name: "etc", Type: tar.TypeDir}, {Name: "etc/a", Type: tar.TypeReg}},
+				{{Name: "etc", Type: tar.TypeDir}, {Name: "etc/b", Type: tar.TypeReg}},
+			},
+			want: []string{"etc 1", "etc/a 0", "etc/b 1"},
+		},
+		{
+			name: "file replaces a directory",
+			indexes: [][]rootFSEntry{
+				{{Name: "opt/app", Type: tar.TypeDir}, {Name: "opt/app/bin", Type: tar.TypeReg}},
+				{{Name: "opt/app", Type: tar.TypeSymlink, Linkname: "/usr/lib/app"}},
+			},
+			want: []string{"opt 0", "opt/app 1"},
+		},
+		{
+			name: "links are kept, devices and escaping paths skipped",
+			indexes: [][]rootFSEntry{
+				{
+					{Name: "bin/tool", Type: tar.TypeReg},
+					{Name: "bin/link", Type: tar.TypeLink, Linkname: "bin/tool"},
+					{Name: "bin/sym", Type: tar.TypeSymlink, Linkname: "tool"},
+					{Name: "dev/null", Type: tar.TypeChar},
+					{Name: "../escape", Type: tar.TypeReg},
+				},
+			},
+			want: []string{"bin 0", "bin/link 0", "bin/sym 0", "bin/tool 0"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			newRootFSTree(test.indexes).walk("", func(name string, node *rootFSNode) bool {
+				got = append(got, name+" "+strconv.Itoa(node.layer))
+				return true
+			})
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestHardlinkMatches(t *testing.T) {
+	setupDiskSpaceDirs(t)
+	writeFile(t, filepath.Join(config.RootDir, "bin", "tool"), "tool")
+	writeFile(t, filepath.Join(config.RootDir, "bin", "copy"), "tool")
+	if err := os.Link(filepath.Join(config.RootDir, "bin", "tool"), filepath.Join(config.RootDir, "bin", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		replaced bool
+		want     bool
+	}{
+		{name: "linked to its target", path: "link", want: true},
+		{name: "not linked to its target", path: "copy"},
+		{name: "target replaced by a later layer", path: "copy", replaced: true, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indexes := [][]rootFSEntry{{
+				{Name: "bin/tool", Type: tar.TypeReg},
+				{Name: "bin/" + test.path, Type: tar.TypeLink, Linkname: "bin/tool"},
+			}}
+			if test.replaced {
+				indexes = append(indexes, []rootFSEntry{{Name: "bin/tool", Type: tar.TypeReg}})
+			}
+
+			tree := newRootFSTree(indexes)
+			path := filepath.Join(config.RootDir, "bin", test.path)
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tree.lookup("bin/"+test.path).matches(tree, path, info); got != test.want {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestReusableLayers(t *testing.T) {
+	small := testLayer(t, regFile("etc/small", "small"))
+	big := testLayer(t, regFile("usr/lib/big", randomContent(1<<16)))
+	built := testLayer(t, regFile("app/bin", "app"))
+
+	tests := []struct {
+		name      string
+		layers    []v1.Layer
+		previous  []v1.Layer
+		unindexed []v1.Layer
+		want      int
+	}{
+		{name: "nothing recorded", layers: []v1.Layer{small, big}},
+		{name: "all layers extracted", layers: []v1.Layer{small, big}, previous: []v1.Layer{small, big, built}, want: 2},
+		{name: "most of the base image changed", layers: []v1.Layer{small, big}, previous: []v1.Layer{small, built}},
+		{name: "small layer changed", layers: []v1.Layer{big, small}, previous: []v1.Layer{big, built}, want: 1},
+		{name: "built layer without index", layers: []v1.Layer{big, small}, previous: []v1.Layer{big, built}, unindexed: []v1.Layer{built}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupDiskSpaceDirs(t)
+			if test.previous != nil {
+				for _, layer := range test.previous {
+					err := indexLayer(layer, layerDiffID(t, layer))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				writeTestRootFS(t, test.previous...)
+				for _, layer := range test.unindexed {
+					err := os.Remove(layerIndexPath(layerDiffID(t, layer)))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			diffIDs := []v1.Hash{}
+			for _, layer := range test.layers {
+				diffIDs = append(diffIDs, layerDiffID(t, layer))
+			}
+			extracted, err := reusableLayers(test.layers, diffIDs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(extracted.indexes) != test.want {
+				t.Fatalf("expected %d reusable layers, got %d", test.want, len(extracted.indexes))
+			} else if test.want > 0 && !extracted.changed["app/bin"] {
+				t.Fatalf("expected the built file to be changed, got %v", extracted.changed)
+			}
+		})
+	}
+}
+
+func TestResetRootFS(t *testing.T) {
+	setupDiskSpaceDirs(t)
+	if err := util.InitIgnoreList(false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = util.InitIgnoreList(false) })
+	util.AddToIgnoreList(util.IgnoreListEntry{Path: filepath.Join(config.RootDir, "var", "cache")})
+
+	base := testLayer(t,
+		dirEntry("etc"),
+		regFile("etc/a", "a"),
+		regFile("etc/b", "b"),
+		regFile("etc/c", "c"),
+		symlink("etc/sym", "a"),
+		dirEntry("bin"),
+		regFile("bin/tool", "tool"),
+		hardlink("bin/link", "bin/tool"),
+	)
+	// the built layer keeps the modification time of the files it replaces, like cp -p does
+	built := testLayer(t,
+		regFile("etc/b", "B"),
+		regFile("etc/.wh.a", ""),
+		regFile("etc/new", "new"),
+		regFile("bin/tool", "tool2"),
+	)
+	for _, layer := range []v1.Layer{base, built} {
+		extractTestLayer(t, layer)
+		err := indexLayer(layer, layerDiffID(t, layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestRootFS(t, base, built)
+
+	// the status change time is coarser than time.Now
+	time.Sleep(20 * time.Millisecond)
+	writeFile(t, filepath.Join(config.RootDir, "etc", "c"), "C")
+	if err := os.Chtimes(filepath.Join(config.RootDir, "etc", "c"), testModTime, testModTime); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(config.RootDir, "extra"), "extra")
+	writeFile(t, filepath.Join(config.RootDir, "var", "other"), "other")
+	writeFile(t, filepath.Join(config.RootDir, "var", "cache", "keep"), "keep")
+
+	extracted, err := extractedLayers([]v1.Hash{layerDiffID(t, base)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"etc/a": true, "etc/b": true, "etc/new": true, "bin/tool": true}
+	if !reflect.DeepEqual(extracted.changed, want) {
+		t.Fatalf("expected changed files %v, got %v", want, extracted.changed)
+	}
+
+	reset, err := resetRootFS([]v1.Layer{base}, extracted, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if reset == 0 {
+		t.Fatal("expected paths to be reset")
+	}
+
+	for name, content := range map[string]string{
+		"etc/a":          "a",
+		"etc/b":          "b",
+		"etc/c":          "c",
+		"bin/tool":       "tool",
+		"bin/link":       "tool",
+		"var/cache/keep": "keep",
+	} {
+		got, err := os.ReadFile(filepath.Join(config.RootDir, name))
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != content {
+			t.Errorf("%s: expected %q, got %q", name, content, got)
+		}
+	}
+	for _, name := range []string{"etc/new", "extra", "var/other"} {
+		if _, err := os.Lstat(filepath.Join(config.RootDir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: expected to be removed, got %v", name, err)
+		}
+	}
+
+	link, err := os.Readlink(filepath.Join(config.RootDir, "etc", "sym"))
+	if err != nil || link != "a" {
+		t.Fatalf("expected symlink to a, got %s, %v", link, err)
+	}
+	tool, err := os.Stat(filepath.Join(config.RootDir, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hardlink, err := os.Stat(filepath.Join(config.RootDir, "bin", "link"))
+	if err != nil || !os.SameFile(tool, hardlink) {
+		t.Fatalf("expected bin/link to be linked to bin/tool, got %v", err)
+	}
+}
+
+type testLayerFile struct {
+	hdr     *tar.Header
+	content string
+}
+
+func regFile(name, content string) testLayerFile {
+	return testLayerFile{hdr: &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}, content: content}
+}
+
+func dirEntry(name string) testLayerFile {
+	return testLayerFile{hdr: &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}}
+}
+
+func symlink(name, target string) testLayerFile {
+	return testLayerFile{hdr: &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}}
+}
+
+func hardlink(name, target string) testLayerFile {
+	return testLayerFile{hdr: &tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target, Mode: 0644}}
+}
+
+func testLayer(t *testing.T, files ...testLayerFile) v1.Layer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(buf)
+	for _, file := range files {
+		file.hdr.ModTime = testModTime
+		file.hdr.Uid, file.hdr.Gid = os.Getuid(), os.Getgid()
+		err := tarWriter.WriteHeader(file.hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tarWriter.Write([]byte(file.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return layer
+}
+
+// extractTestLayer extracts a layer on / the way kaniko does during the build
+func extractTestLayer(t *testing.T, layer v1.Layer) {
+	t.Helper()
+
+	r, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		name := layerPath(hdr.Name)
+		dir, base := filepath.Split(name)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			err = os.RemoveAll(filepath.Join(config.RootDir, dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		} else {
+			err = util.ExtractFile(config.RootDir, hdr, name, tr)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeTestRootFS(t *testing.T, layers ...v1.Layer) {
+	t.Helper()
+
+	diffIDs := []v1.Hash{}
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, layerDiffID(t, layer))
+	}
+
+	err := writeRootFS(diffIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func layerDiffID(t *testing.T, layer v1.Layer) v1.Hash {
+	t.Helper()
+
+	diffID, err := layer.DiffID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return diffID
+}
+
+// randomContent returns content that does not compress
+func randomContent(size int) string {
+	content := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(1)).Read(content)
+	return string(content)
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ContainerMarker is created in the dockerless image to mark it as safe to delete
+var ContainerMarker = "/.dockerless/marker"
+
+var ErrNotInContainer = errors.New("refusing to delete the filesystem, because dockerless cannot find any evidence that it runs inside a container (use --i-know-what-i-am-doing to override)")
+
+// containerRuntimeFiles are created by container runtimes inside the container
+var containerRuntimeFiles = []string{
+	"/.dockerenv",
+	"/run/.containerenv",
+}
+
+// CgroupFile and MountInfoFile are read to find the cgroup and root filesystem of the container
+var (
+	CgroupFile    = "/proc/1/cgroup"
+	MountInfoFile = "/proc/self/mountinfo"
+)
+
+// containerCgroupPrefixes are path components that container runtimes use for the cgroups of containers,
+// e.g. /kubepods/burstable/pod<uid>/<id> or /system.slice/docker-<id>.scope
+var containerCgroupPrefixes = []string{
+	"docker-",
+	"kubepods",
+	"libpod-",
+	"crio-",
+	"cri-containerd-",
+	"lxc.payload.",
+}
+
+// containerCgroupNames are complete path components that container runtimes use, e.g. /docker/<id>
+var containerCgroupNames = map[string]bool{
+	"docker": true,
+	"lxc":    true,
+}
+
+// containerStoragePaths are part of the overlay options of the root filesystem of a container
+var containerStoragePaths = []string{
+	"/var/lib/docker/",
+	"/containers/storage/",
+	"/io.containerd.snapshotter.",
+}
+
+// containerMountPoints are only mounted into containers
+var containerMountPoints = []string{
+	"/var/run/secrets/kubernetes.io/serviceaccount",
+	"/run/secrets/kubernetes.io/serviceaccount",
+}
+
+// ensureContainer returns an error if we cannot find any evidence that we are running inside a container
+func ensureContainer() error {
+	reason, ok := detectContainer()
+	if !ok {
+		return ErrNotInContainer
+	}
+
+	fmt.Printf("detected container environment: %s\n", reason)
+	return nil
+}
+
+// detectContainer looks for positive evidence that we are running inside a container and returns the
+// first one it finds. Anything that can be set outside of a container, such as the container env
+// variable or the name of pid 1, does not count.
+func detectContainer() (string, bool) {
+	if fileExists(ContainerMarker) {
+		return "found dockerless marker " + ContainerMarker, true
+	}
+
+	for _, runtimeFile := range containerRuntimeFiles {
+		if fileExists(runtimeFile) {
+			return "found container runtime file " + runtimeFile, true
+		}
+	}
+
+	if line, ok := findLine(CgroupFile, isContainerCgroup); ok {
+		return "found container cgroup " + line, true
+	}
+
+	if line, ok := findLine(MountInfoFile, isContainerMount); ok {
+		return "found container mount " + line, true
+	}
+
+	return "", false
+}
+
+// isContainerCgroup checks if a line of /proc/1/cgroup, e.g. 0::/kubepods/pod1234/abcd, belongs to a container
+func isContainerCgroup(line string) bool {
+	fields := strings.SplitN(line, ":", 3)
+	if len(fields) != 3 {
+		return false
+	}
+
+	for _, component := range strings.Split(fields[2], "/") {
+		if containerCgroupNames[component] {
+			return true
+		}
+		for _, prefix := range containerCgroupPrefixes {
+			if strings.HasPrefix(component, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isContainerMount checks if a line of /proc/self/mountinfo is the overlay root filesystem of a
+// container runtime or a mount that only exists in containers. Lines look like:
+// 36 35 98:0 / / rw,noatime master:1 - overlay overlay rw,lowerdir=/var/lib/docker/overlay2/l/ABC
+func isContainerMount(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return false
+	}
+
+	mountPoint := fields[4]
+	for _, containerMountPoint := range containerMountPoints {
+		if mountPoint == containerMountPoint {
+			return true
+		}
+	}
+	if mountPoint != "/" {
+		return false
+	}
+
+	for i, field := range fields {
+		if field != "-" || i+3 >= len(fields) || fields[i+1] != "overlay" {
+			continue
+		}
+
+		for _, storagePath := range containerStoragePaths {
+			if strings.Contains(fields[i+3], storagePath) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func findLine(path string, match func(line string) bool) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if match(scanner.Text()) {
+			return scanner.Text(), true
+		}
+	}
+
+	return "", false
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
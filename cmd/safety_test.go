@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectContainer(t *testing.T) {
+	marker, runtimeFiles, cgroupFile, mountInfoFile := ContainerMarker, containerRuntimeFiles, CgroupFile, MountInfoFile
+	defer func() {
+		ContainerMarker, containerRuntimeFiles, CgroupFile, MountInfoFile = marker, runtimeFiles, cgroupFile, mountInfoFile
+	}()
+
+	hostMountInfo := "28 1 254:0 / / rw,relatime - ext4 /dev/vda rw\n"
+	hostCgroup := "0::/init.scope\n"
+
+	tests := []struct {
+		name      string
+		files     []string
+		cgroup    string
+		mountInfo string
+		want      bool
+	}{
+		{name: "host", cgroup: hostCgroup, mountInfo: hostMountInfo},
+		{name: "host with lxcfs", cgroup: "0::/system.slice/lxcfs.service\n", mountInfo: hostMountInfo},
+		{name: "live system with overlay root", cgroup: hostCgroup, mountInfo: "30 1 0:28 / / rw - overlay overlay rw,lowerdir=/run/live/rootfs/filesystem.squashfs,upperdir=/run/live/overlay/rw\n"},
+		{name: "dockerless marker", files: []string{"marker"}, cgroup: hostCgroup, mountInfo: hostMountInfo, want: true},
+		{name: "dockerenv", files: []string{".dockerenv"}, cgroup: hostCgroup, mountInfo: hostMountInfo, want: true},
+		{name: "docker cgroup v1", cgroup: "12:memory:/docker/0123456789ab\n", mountInfo: hostMountInfo, want: true},
+		{name: "docker systemd cgroup", cgroup: "0::/system.slice/docker-0123456789ab.scope\n", mountInfo: hostMountInfo, want: true},
+		{name: "kubernetes cgroup", cgroup: "0::/kubepods.slice/kubepods-burstable.slice/cri-containerd-0123.scope\n", mountInfo: hostMountInfo, want: true},
+		{name: "lxc container", cgroup: "0::/lxc.payload.dev\n", mountInfo: hostMountInfo, want: true},
+		{name: "docker overlay root", cgroup: "0::/\n", mountInfo: "36 35 98:0 / / rw - overlay overlay rw,lowerdir=/var/lib/docker/overlay2/l/ABC,upperdir=/var/lib/docker/overlay2/1/diff\n", want: true},
+		{name: "containerd overlay root", cgroup: "0::/\n", mountInfo: "36 35 98:0 / / rw - overlay overlay rw,lowerdir=/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs/snapshots/1/fs\n", want: true},
+		{name: "kubernetes service account", cgroup: "0::/\n", mountInfo: hostMountInfo + "40 36 0:50 / /var/run/secrets/kubernetes.io/serviceaccount ro - tmpfs tmpfs ro\n", want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ContainerMarker = filepath.Join(dir, "marker")
+			containerRuntimeFiles = []string{filepath.Join(dir, ".dockerenv"), filepath.Join(dir, ".containerenv")}
+			CgroupFile = filepath.Join(dir, "cgroup")
+			MountInfoFile = filepath.Join(dir, "mountinfo")
+			writeFile(t, CgroupFile, test.cgroup)
+			writeFile(t, MountInfoFile, test.mountInfo)
+			for _, file := range test.files {
+				writeFile(t, filepath.Join(dir, file), "")
+			}
+
+			t.Setenv("container", "docker")
+			reason, got := detectContainer()
+			if got != test.want {
+				t.Fatalf("expected %v, got %v (%s)", test.want, got, reason)
+			}
+		})
+	}
+}
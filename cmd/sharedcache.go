@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// layerCacheDir is the private OCI layout cache kaniko uses while a shared cache dir is configured.
+// It links the entries of the shared cache dir, so kaniko never writes into the shared cache dir directly.
+var layerCacheDir = "/.dockerless/layers"
+
+// layerCacheRepo is the repo name kaniko prefixes the cache keys with, entries are named layer:<key>
+const layerCacheRepo = "layer"
+
+// ociCachePrefix marks a cache repo as OCI layout directory
+const ociCachePrefix = "oci:"
+
+// sharedCache is an OCI layout cache dir that several containers use at the same time. kaniko writes
+// layouts non-atomically, so entries are published into the shared cache dir by renaming them.
+type sharedCache struct {
+	dir      string
+	cacheTTL time.Duration
+
+	lock *stateLock
+
+	// used are the entries kaniko has looked up during the build
+	used map[string]bool
+	m    sync.Mutex
+}
+
+// sharedCacheDirFromRepo returns the directory of an oci:/path cache or an empty string for registry caches
+func sharedCacheDirFromRepo(cache string) string {
+	if !strings.HasPrefix(cache, ociCachePrefix) {
+		return ""
+	}
+
+	return filepath.Clean(strings.TrimPrefix(cache, ociCachePrefix))
+}
+
+// resolveSharedCacheDir falls back to DOCKERLESS_CACHE_DIR_SHARED and removes the optional oci: prefix
+func resolveSharedCacheDir(dir string) string {
+	if dir == "" {
+		dir = os.Getenv("DOCKERLESS_CACHE_DIR_SHARED")
+	}
+	if dir == "" {
+		return ""
+	}
+
+	return filepath.Clean(strings.TrimPrefix(dir, ociCachePrefix))
+}
+
+// openSharedCache locks the shared cache dir and links its valid entries into layerCacheDir
+func openSharedCache(dir string, cacheTTL time.Duration) (*sharedCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create shared cache dir: %w", err)
+	}
+
+	// start with an empty private cache, so we do not publish leftovers of a previous build
+	err = os.RemoveAll(layerCacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("clean layer cache: %w", err)
+	}
+	err = os.MkdirAll(layerCacheDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create layer cache: %w", err)
+	}
+
+	lock, err := lockCacheDir(dir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		lock.Unlock()
+		return nil, fmt.Errorf("read shared cache dir: %w", err)
+	}
+	for _, file := range files {
+		if !file.IsDir() || !strings.HasPrefix(file.Name(), layerCacheRepo+":") {
+			continue
+		}
+
+		// kaniko rebuilds expired entries and would write them through the link into the shared cache dir
+		info, err := file.Info()
+		if err != nil || info.ModTime().Add(cacheTTL).Before(time.Now()) {
+			continue
+		}
+
+		err = os.Symlink(filepath.Join(dir, file.Name()), filepath.Join(layerCacheDir, file.Name()))
+		if err != nil {
+			lock.Unlock()
+			return nil, fmt.Errorf("link shared cache entry %s: %w", file.Name(), err)
+		}
+	}
+
+	cache := &sharedCache{dir: dir, cacheTTL: cacheTTL, lock: lock, used: map[string]bool{}}
+	logrus.AddHook(cache)
+	return cache, nil
+}
+
+func (c *sharedCache) Levels() []logrus.Level {
+	return []logrus.Level{logrus.InfoLevel}
+}
+
+// Fire remembers the entries kaniko looks up, so publish can mark them as used
+func (c *sharedCache) Fire(entry *logrus.Entry) error {
+	matches := checkingCacheRegEx.FindStringSubmatch(entry.Message)
+	if len(matches) != 2 || !strings.HasPrefix(matches[1], sharedCacheRepo()+":") {
+		return nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.used[filepath.Base(matches[1])] = true
+	return nil
+}
+
+// sharedCacheRepo returns the cache repo kaniko reads and writes layers with while a shared cache dir is used
+func sharedCacheRepo() string {
+	return ociCachePrefix + filepath.Join(layerCacheDir, layerCacheRepo)
+}
+
+// publish copies the layers kaniko has written during the build into the shared cache dir and releases the lock.
+// Entries that another build has published in the meantime are kept.
+func (c *sharedCache) publish() error {
+	defer c.lock.Unlock()
+
+	files, err := os.ReadDir(layerCacheDir)
+	if err != nil {
+		return fmt.Errorf("read layer cache: %w", err)
+	}
+
+	published := 0
+	for _, file := range files {
+		// links point to entries that are already in the shared cache dir
+		if !file.IsDir() {
+			continue
+		}
+
+		ok, err := c.publishEntry(file.Name())
+		if err != nil {
+			return fmt.Errorf("publish cache entry %s: %w", file.Name(), err)
+		} else if ok {
+			published++
+		}
+	}
+
+	if published > 0 {
+		fmt.Printf("published %d layers to shared cache %s\n", published, c.dir)
+	}
+
+	// the layers kaniko has looked up are either reused or were just published
+	c.m.Lock()
+	used := []string{}
+	for key := range c.used {
+		used = append(used, key)
+	}
+	c.m.Unlock()
+	return markCacheEntriesUsed(c.dir, used)
+}
+
+func (c *sharedCache) publishEntry(key string) (bool, error) {
+	tempDir, err := os.MkdirTemp(c.dir, ".publish-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	// the temporary dir becomes the entry, which other containers must be able to read
+	err = os.Chmod(tempDir, 0755)
+	if err != nil {
+		return false, err
+	}
+
+	err = copyDir(filepath.Join(layerCacheDir, key), tempDir)
+	if err != nil {
+		return false, err
+	}
+
+	// replace entries that have expired, kaniko has rebuilt them
+	target := filepath.Join(c.dir, key)
+	info, err := os.Stat(target)
+	if err == nil {
+		if !info.ModTime().Add(c.cacheTTL).Before(time.Now()) {
+			return false, nil
+		}
+
+		expiredDir := tempDir + ".expired"
+		err = os.Rename(target, expiredDir)
+		if err != nil {
+			return false, err
+		}
+		defer os.RemoveAll(expiredDir)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	err = os.Rename(tempDir, target)
+	if err != nil {
+		// another build was faster
+		if errors.Is(err, os.ErrExist) || fileExists(target) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// copyDir copies all regular files and directories from src into the existing directory dst
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, relPath)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	_, err = io.Copy(dstFile, srcFile)
+	if err != nil {
+		return err
+	}
+
+	return dstFile.Close()
+}
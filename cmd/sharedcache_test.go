@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSharedCacheMarksUsedLayers(t *testing.T) {
+	layerCacheDir = filepath.Join(t.TempDir(), "layers")
+	dir := t.TempDir()
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeCacheEntry(t, dir, "layer:reused", CacheEntryLayer, created)
+	writeCacheEntry(t, dir, "layer:unused", CacheEntryLayer, created)
+
+	shared, err := openSharedCache(dir, defaultCacheTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// kaniko looks up every layer and writes the ones it has built into the private layer cache
+	writeCacheEntry(t, layerCacheDir, "layer:built", CacheEntryLayer, time.Now())
+	for _, key := range []string{"reused", "built"} {
+		_ = shared.Fire(&logrus.Entry{Message: "Checking for cached layer " + sharedCacheRepo() + ":" + key + "..."})
+	}
+	_ = shared.Fire(&logrus.Entry{Message: "Checking for cached layer my.registry/cache:unused..."})
+
+	err = shared.publish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, wantUsed := range map[string]bool{"layer:reused": true, "layer:built": true, "layer:unused": false} {
+		entry, err := readCacheEntry(dir, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		used := fileExists(filepath.Join(dir, lastUsedDir, key)) && time.Since(entry.LastUsed) < time.Minute
+		if used != wantUsed {
+			t.Errorf("%s: expected used %v, got last used %s", key, wantUsed, entry.LastUsed)
+		}
+	}
+}
+
+func TestSharedCacheDirFromRepo(t *testing.T) {
+	tests := map[string]string{
+		"oci:/mnt/cache":        "/mnt/cache",
+		"oci:/mnt/cache/":       "/mnt/cache",
+		"my.registry/cache":     "",
+		"":                      "",
+		"oci:relative/../cache": "cache",
+	}
+	for repo, want := range tests {
+		if got := sharedCacheDirFromRepo(repo); got != want {
+			t.Errorf("%s: expected %q, got %q", repo, want, got)
+		}
+	}
+}
+
+func TestSharedCachePublish(t *testing.T) {
+	layerCacheDir = filepath.Join(t.TempDir(), "layers")
+	dir := t.TempDir()
+	expired := time.Now().Add(-2 * defaultCacheTTL)
+	writeCacheEntry(t, dir, "layer:expired", CacheEntryLayer, expired)
+	writeCacheEntry(t, dir, "layer:valid", CacheEntryLayer, time.Now().Add(-time.Hour))
+
+	shared, err := openSharedCache(dir, defaultCacheTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only valid entries are linked, kaniko would otherwise write rebuilt layers through the link
+	links, err := os.ReadDir(layerCacheDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(links) != 1 || links[0].Name() != "layer:valid" || links[0].Type()&os.ModeSymlink == 0 {
+		t.Fatalf("expected only layer:valid to be linked, got %v", links)
+	}
+
+	// the shared cache dir cannot be pruned while a build uses it
+	_, err = lockCacheDir(dir, true)
+	if !errors.Is(err, ErrCacheDirInUse) {
+		t.Fatalf("expected ErrCacheDirInUse, got %v", err)
+	}
+
+	writeCacheEntry(t, layerCacheDir, "layer:expired", CacheEntryLayer, time.Now())
+	writeCacheEntry(t, layerCacheDir, "layer:new", CacheEntryLayer, time.Now())
+	err = shared.publish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"layer:expired", "layer:new", "layer:valid"} {
+		entry, err := readCacheEntry(dir, key)
+		if err != nil {
+			t.Fatal(err)
+		} else if entry.expired(defaultCacheTTL) {
+			t.Fatalf("expected %s to be replaced", key)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "layer:new"))
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0755 {
+		t.Fatalf("expected published entry to be readable by everyone, got %s", info.Mode().Perm())
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, ".publish-*"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) > 0 {
+		t.Fatalf("expected temporary dirs to be removed, got %v", files)
+	}
+
+	lock, err := lockCacheDir(dir, true)
+	if err != nil {
+		t.Fatalf("expected publish to release the lock: %v", err)
+	}
+	lock.Unlock()
+}
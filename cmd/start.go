@@ -19,6 +19,8 @@ import (
 var (
 	ErrContainerAlreadyRunning = errors.New("container is already running")
 	ErrNoEntrypoint            = errors.New("no entrypoint specified")
+	ErrBuildFailed             = errors.New("build failed")
+	ErrWaitTimeout             = errors.New("timed out waiting for the build")
 )
 
 var ContainerConfigOutput = "/.dockerless/container.json"
@@ -33,7 +35,8 @@ type StartCmd struct {
 	Env    []string
 	Labels []string
 
-	Wait bool
+	Wait        bool
+	WaitTimeout time.Duration
 }
 
 // NewStartCmd returns a new start command
@@ -50,6 +53,7 @@ func NewStartCmd() *cobra.Command {
 	}
 
 	cobraCmd.Flags().BoolVar(&cmd.Wait, "wait", false, "If true, will wait until the container is built.")
+	cobraCmd.Flags().DurationVar(&cmd.WaitTimeout, "wait-timeout", 0, "How long to wait for the build with --wait. 0 waits forever.")
 	cobraCmd.Flags().StringVar(&cmd.User, "user", "", "The container user to run the entrypoint with.")
 	cobraCmd.Flags().StringArrayVar(&cmd.Entrypoint, "entrypoint", []string{}, "The entrypoint to use.")
 	cobraCmd.Flags().StringArrayVar(&cmd.Cmd, "cmd", []string{}, "The cmds to use.")
@@ -64,23 +68,16 @@ func (cmd *StartCmd) Run() error {
 		return ErrContainerAlreadyRunning
 	}
 
-	// get the built image config
-	var (
-		out []byte
-		err error
-	)
-	for {
-		out, err = os.ReadFile(ImageConfigOutput)
-		if err != nil {
-			if !cmd.Wait {
-				return fmt.Errorf("read image config: %w", err)
-			}
-
-			time.Sleep(time.Second)
-			continue
-		}
+	// get the built image config, we hold the lock until the container state is written
+	out, lock, err := cmd.waitForImageConfig()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 
-		break
+	// make sure nobody started the container while we were waiting
+	if isContainerRunning() {
+		return ErrContainerAlreadyRunning
 	}
 
 	// unmarshal the config file
@@ -159,15 +156,16 @@ func (cmd *StartCmd) Run() error {
 		return fmt.Errorf("marshal config file: %w", err)
 	}
 
-	err = os.WriteFile(ContainerConfigOutput, out, 0666)
+	err = writeStateFile(ContainerConfigOutput, out)
 	if err != nil {
 		return fmt.Errorf("write container config: %w", err)
 	}
 
-	err = os.WriteFile(ContainerPID, []byte(strconv.Itoa(os.Getpid())), 0666)
+	err = writeStateFile(ContainerPID, []byte(strconv.Itoa(os.Getpid())))
 	if err != nil {
 		return fmt.Errorf("write container pid: %w", err)
 	}
+	lock.Unlock()
 
 	// set container env before execution so we find executables
 	for _, env := range containerEnv {
@@ -197,6 +195,49 @@ func (cmd *StartCmd) Run() error {
 	return nil
 }
 
+// waitForImageConfig locks the state and reads the built image config. With --wait it waits
+// until the build has written the config and returns an error as soon as the build has failed.
+func (cmd *StartCmd) waitForImageConfig() ([]byte, *stateLock, error) {
+	start := time.Now()
+	for {
+		// only lock the state once there is an image config, so polling never makes a build that
+		// starts in the meantime fail with ErrBuildInProgress
+		_, err := os.Stat(ImageConfigOutput)
+		if err == nil || !cmd.Wait {
+			lock, err := lockState()
+			if err == nil {
+				out, err := os.ReadFile(ImageConfigOutput)
+				if err == nil {
+					return out, lock, nil
+				}
+
+				lock.Unlock()
+				if !cmd.Wait {
+					return nil, nil, fmt.Errorf("read image config: %w", err)
+				}
+			} else if !cmd.Wait || !errors.Is(err, ErrBuildInProgress) {
+				return nil, nil, err
+			}
+		}
+
+		// a build that failed before we started waiting is not the one we wait for
+		status, statusErr := readBuildStatus()
+		if statusErr == nil && status.failedSince(start) {
+			if status.FailedStage != "" {
+				return nil, nil, fmt.Errorf("%w in stage %s: %s", ErrBuildFailed, status.FailedStage, status.Error)
+			}
+
+			return nil, nil, fmt.Errorf("%w: %s", ErrBuildFailed, status.Error)
+		}
+
+		if cmd.WaitTimeout > 0 && time.Since(start) > cmd.WaitTimeout {
+			return nil, nil, fmt.Errorf("%w after %s", ErrWaitTimeout, cmd.WaitTimeout)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
 func isContainerRunning() bool {
 	pid, err := os.ReadFile(ContainerPID)
 	if err == nil {
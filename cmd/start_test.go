@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupStateFiles(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	LockFile = filepath.Join(dir, "lock")
+	ImageConfigOutput = filepath.Join(dir, "image.json")
+	BuildStatusOutput = filepath.Join(dir, "status.json")
+}
+
+func TestWaitForImageConfig(t *testing.T) {
+	setupStateFiles(t)
+
+	_, _, err := (&StartCmd{}).waitForImageConfig()
+	if err == nil {
+		t.Fatal("expected error without image config")
+	}
+
+	writeFile(t, ImageConfigOutput, `{"config":{}}`)
+	out, lock, err := (&StartCmd{}).waitForImageConfig()
+	if err != nil {
+		t.Fatal(err)
+	} else if string(out) != `{"config":{}}` {
+		t.Fatalf("unexpected image config %s", out)
+	}
+
+	_, err = lockState()
+	if !errors.Is(err, ErrBuildInProgress) {
+		t.Fatalf("expected the state to be locked, got %v", err)
+	}
+	lock.Unlock()
+
+	// a running build holds the lock
+	buildLock, err := lockState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buildLock.Unlock()
+
+	_, _, err = (&StartCmd{}).waitForImageConfig()
+	if !errors.Is(err, ErrBuildInProgress) {
+		t.Fatalf("expected ErrBuildInProgress, got %v", err)
+	}
+
+	_, _, err = (&StartCmd{Wait: true, WaitTimeout: time.Millisecond}).waitForImageConfig()
+	if !errors.Is(err, ErrWaitTimeout) {
+		t.Fatalf("expected ErrWaitTimeout, got %v", err)
+	}
+}
+
+func TestWaitForImageConfigBuildFailed(t *testing.T) {
+	setupStateFiles(t)
+
+	failed, err := newBuildStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = failed.finish(errors.New("exit code 1"), "dev (index 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the build failed before we started waiting
+	_, _, err = (&StartCmd{Wait: true, WaitTimeout: time.Millisecond}).waitForImageConfig()
+	if !errors.Is(err, ErrWaitTimeout) {
+		t.Fatalf("expected ErrWaitTimeout, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		status, _ := newBuildStatus()
+		_ = status.finish(errors.New("exit code 2"), "")
+	}()
+
+	_, _, err = (&StartCmd{Wait: true, WaitTimeout: 10 * time.Second}).waitForImageConfig()
+	if !errors.Is(err, ErrBuildFailed) {
+		t.Fatalf("expected ErrBuildFailed, got %v", err)
+	}
+}
+
+func TestWaitForImageConfigDoesNotLockWhilePolling(t *testing.T) {
+	setupStateFiles(t)
+
+	type result struct {
+		lock *stateLock
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		_, lock, err := (&StartCmd{Wait: true, WaitTimeout: 10 * time.Second}).waitForImageConfig()
+		done <- result{lock: lock, err: err}
+	}()
+
+	// builds can start at any time while start --wait polls
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		lock, err := lockState()
+		if err != nil {
+			t.Fatalf("build could not lock the state while start --wait was polling: %v", err)
+		}
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	writeFile(t, ImageConfigOutput, `{"config":{}}`)
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	res.lock.Unlock()
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// LockFile is locked while a build runs or a container is started
+var LockFile = "/.dockerless/lock"
+
+var ErrBuildInProgress = errors.New("another build is in progress")
+
+// writeStateFile atomically replaces path with data, so readers never see a partially written file
+func writeStateFile(path string, data []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	_, err = tempFile.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = tempFile.Chmod(0666)
+	if err != nil {
+		return err
+	}
+
+	err = tempFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+// stateLock is an advisory lock on LockFile that serializes builds and container starts, or on a cache dir
+type stateLock struct {
+	file *os.File
+}
+
+// lockState acquires the state lock or returns ErrBuildInProgress if somebody else holds it
+func lockState() (*stateLock, error) {
+	file, err := os.OpenFile(LockFile, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrBuildInProgress
+		}
+
+		return nil, fmt.Errorf("lock %s: %w", LockFile, err)
+	}
+
+	return &stateLock{file: file}, nil
+}
+
+// Unlock releases the lock, it is safe to call it multiple times
+func (l *stateLock) Unlock() {
+	if l.file == nil {
+		return
+	}
+
+	_ = syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	_ = l.file.Close()
+	l.file = nil
+}
+
+// cacheLockFile is the name of the lock file inside a cache dir
+const cacheLockFile = ".lock"
+
+var ErrCacheDirInUse = errors.New("cache dir is in use by a running build")
+
+// lockCacheDir locks cacheDir, which might be shared between several containers. Builds hold a
+// shared lock and wait for it, while commands that remove entries need an exclusive lock and
+// return ErrCacheDirInUse if a build is using the cache dir.
+func lockCacheDir(cacheDir string, exclusive bool) (*stateLock, error) {
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+
+	path := filepath.Join(cacheDir, cacheLockFile)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open cache lock file: %w", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX | syscall.LOCK_NB
+	}
+	err = syscall.Flock(int(file.Fd()), how)
+	if err != nil {
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrCacheDirInUse
+		}
+
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+
+	return &stateLock{file: file}, nil
+}
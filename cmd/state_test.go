@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStateFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	for _, content := range []string{"first", "second"} {
+		err := writeStateFile(path, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(out) != content {
+			t.Fatalf("expected %q, got %q", content, out)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Fatalf("expected temporary files to be removed, got %d entries", len(entries))
+	}
+}
+
+func TestLockState(t *testing.T) {
+	setupStateFiles(t)
+
+	lock, err := lockState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = lockState()
+	if !errors.Is(err, ErrBuildInProgress) {
+		t.Fatalf("expected ErrBuildInProgress, got %v", err)
+	}
+
+	lock.Unlock()
+	lock.Unlock()
+
+	lock, err = lockState()
+	if err != nil {
+		t.Fatalf("expected lock to be released: %v", err)
+	}
+	lock.Unlock()
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var BuildStatusOutput = "/.dockerless/status.json"
+
+// BuildPhase is the phase a build is currently in
+type BuildPhase string
+
+const (
+	BuildPhaseBuilding    BuildPhase = "Building"
+	BuildPhaseSucceeded   BuildPhase = "Succeeded"
+	BuildPhaseFailed      BuildPhase = "Failed"
+	BuildPhaseInterrupted BuildPhase = "Interrupted"
+)
+
+// BuildStatus is persisted during the build, so other commands can observe its progress
+type BuildStatus struct {
+	StartedAt   time.Time  `json:"startedAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Phase       BuildPhase `json:"phase"`
+	Error       string     `json:"error,omitempty"`
+	FailedStage string     `json:"failedStage,omitempty"`
+}
+
+// newBuildStatus marks a build as started
+func newBuildStatus() (*BuildStatus, error) {
+	status := &BuildStatus{
+		StartedAt: time.Now(),
+		Phase:     BuildPhaseBuilding,
+	}
+
+	return status, status.write()
+}
+
+// finish records the result of the build
+func (s *BuildStatus) finish(buildErr error, stage string) error {
+	now := time.Now()
+	s.FinishedAt = &now
+	if errors.Is(buildErr, ErrBuildInterrupted) {
+		s.Phase = BuildPhaseInterrupted
+		s.Error = buildErr.Error()
+		s.FailedStage = stage
+	} else if buildErr != nil {
+		s.Phase = BuildPhaseFailed
+		s.Error = buildErr.Error()
+		s.FailedStage = stage
+	} else {
+		s.Phase = BuildPhaseSucceeded
+	}
+
+	return s.write()
+}
+
+// failedSince returns true if the build failed or was interrupted after t
+func (s *BuildStatus) failedSince(t time.Time) bool {
+	if s.Phase != BuildPhaseFailed && s.Phase != BuildPhaseInterrupted {
+		return false
+	}
+
+	return s.FinishedAt != nil && !s.FinishedAt.Before(t)
+}
+
+func (s *BuildStatus) write() error {
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal build status: %w", err)
+	}
+
+	err = writeStateFile(BuildStatusOutput, out)
+	if err != nil {
+		return fmt.Errorf("write build status: %w", err)
+	}
+
+	return nil
+}
+
+func readBuildStatus() (*BuildStatus, error) {
+	out, err := os.ReadFile(BuildStatusOutput)
+	if err != nil {
+		return nil, fmt.Errorf("read build status: %w", err)
+	}
+
+	status := &BuildStatus{}
+	err = json.Unmarshal(out, status)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal build status: %w", err)
+	}
+
+	return status, nil
+}
+
+// kaniko logs "Building stage 'alpine' [idx: '0', base-idx: '-1']" before it builds a stage
+var buildingStageRegEx = regexp.MustCompile(`^Building stage '(.*)' \[idx: '(\d+)'`)
+
+// stageTracker is a logrus hook that remembers the stage kaniko is currently building
+type stageTracker struct {
+	stage string
+	m     sync.Mutex
+}
+
+func (t *stageTracker) Levels() []logrus.Level {
+	return []logrus.Level{logrus.InfoLevel}
+}
+
+func (t *stageTracker) Fire(entry *logrus.Entry) error {
+	matches := buildingStageRegEx.FindStringSubmatch(entry.Message)
+	if len(matches) != 3 {
+		return nil
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.stage = fmt.Sprintf("%s (index %s)", matches[1], matches[2])
+	return nil
+}
+
+func (t *stageTracker) Stage() string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.stage
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestBuildStatus(t *testing.T) {
+	BuildStatusOutput = filepath.Join(t.TempDir(), "status.json")
+
+	tests := []struct {
+		name  string
+		err   error
+		phase BuildPhase
+	}{
+		{name: "succeeded", phase: BuildPhaseSucceeded},
+		{name: "failed", err: errors.New("exit code 1"), phase: BuildPhaseFailed},
+		{name: "interrupted", err: ErrBuildInterrupted, phase: BuildPhaseInterrupted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, err := newBuildStatus()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			read, err := readBuildStatus()
+			if err != nil {
+				t.Fatal(err)
+			} else if read.Phase != BuildPhaseBuilding {
+				t.Fatalf("expected %s, got %s", BuildPhaseBuilding, read.Phase)
+			}
+
+			err = status.finish(test.err, "dev (index 1)")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			read, err = readBuildStatus()
+			if err != nil {
+				t.Fatal(err)
+			} else if read.Phase != test.phase || read.FinishedAt == nil {
+				t.Fatalf("expected finished %s, got %+v", test.phase, read)
+			} else if test.err != nil && read.FailedStage != "dev (index 1)" {
+				t.Fatalf("expected failed stage, got %q", read.FailedStage)
+			}
+		})
+	}
+}
+
+func TestBuildStatusFailedSince(t *testing.T) {
+	waitStart := time.Now()
+	before := waitStart.Add(-time.Minute)
+	after := waitStart.Add(time.Minute)
+
+	tests := []struct {
+		name   string
+		status BuildStatus
+		want   bool
+	}{
+		{name: "building", status: BuildStatus{StartedAt: before, Phase: BuildPhaseBuilding}},
+		{name: "succeeded", status: BuildStatus{StartedAt: before, FinishedAt: &after, Phase: BuildPhaseSucceeded}},
+		{name: "failed after wait", status: BuildStatus{StartedAt: before, FinishedAt: &after, Phase: BuildPhaseFailed}, want: true},
+		{name: "interrupted after wait", status: BuildStatus{StartedAt: after, FinishedAt: &after, Phase: BuildPhaseInterrupted}, want: true},
+		{name: "failed before wait", status: BuildStatus{StartedAt: before, FinishedAt: &before, Phase: BuildPhaseFailed}},
+		{name: "failed without finish time", status: BuildStatus{StartedAt: before, Phase: BuildPhaseFailed}},
+	}
+	for _, test := range tests {
+		if got := test.status.failedSince(waitStart); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestStageTracker(t *testing.T) {
+	tracker := &stageTracker{}
+	for _, message := range []string{
+		"Retrieving image manifest alpine",
+		"Building stage 'alpine' [idx: '0', base-idx: '-1']",
+		"Unpacking rootfs as cmd RUN apk add git requires it.",
+	} {
+		_ = tracker.Fire(&logrus.Entry{Message: message})
+	}
+
+	if got := tracker.Stage(); got != "alpine (index 0)" {
+		t.Fatalf("expected alpine (index 0), got %q", got)
+	}
+}
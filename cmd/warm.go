@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	image_remote "github.com/GoogleContainerTools/kaniko/pkg/image/remote"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+var ErrWarmFailed = errors.New("failed to warm any of the given images")
+
+type WarmCmd struct {
+	RegistryFlags
+
+	Dockerfile    string
+	Target        string
+	Platform      string
+	CacheDir      string
+	CacheTTL      time.Duration
+	BuildArgs     []string
+	BuildArgFiles []string
+	Images        []string
+	Parallelism   int
+	Force         bool
+}
+
+// NewWarmCmd returns a new warm command
+func NewWarmCmd() *cobra.Command {
+	cmd := &WarmCmd{}
+	cobraCmd := &cobra.Command{
+		Use:           "warm",
+		Short:         "Pre-populates the base image cache",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			return cmd.Run(cobraCmd.Context())
+		},
+	}
+
+	cobraCmd.Flags().StringVar(&cmd.Dockerfile, "dockerfile", "", "Dockerfile to warm the base images of.")
+	cobraCmd.Flags().StringVar(&cmd.Target, "target", "", "The docker target stage to warm the base images of.")
+	cobraCmd.Flags().StringArrayVar(&cmd.BuildArgs, "build-arg", []string{}, "Docker build args.")
+	cobraCmd.Flags().StringArrayVar(&cmd.BuildArgFiles, "build-arg-file", []string{}, "Dotenv file with build args of the form NAME=value. Can be specified multiple times.")
+	cobraCmd.Flags().StringArrayVar(&cmd.Images, "image", []string{}, "Image to warm. Can be specified multiple times.")
+	cobraCmd.Flags().StringVar(&cmd.Platform, "platform", "", "The platform to warm the images for. Defaults to the platform dockerless runs on.")
+	cobraCmd.Flags().StringVar(&cmd.CacheDir, "cache-dir", defaultCacheDir, "Directory to store the cached images in.")
+	cobraCmd.Flags().DurationVar(&cmd.CacheTTL, "cache-ttl", 0, "How long cached images are valid. Defaults to 168h.")
+	cobraCmd.Flags().IntVar(&cmd.Parallelism, "parallelism", 4, "How many images to fetch in parallel.")
+	cobraCmd.Flags().BoolVar(&cmd.Force, "force", false, "If true will refresh cached images that are past the cache ttl.")
+	cmd.RegistryFlags.addFlags(cobraCmd.Flags())
+	return cobraCmd
+}
+
+func (cmd *WarmCmd) Run(ctx context.Context) error {
+	// abort all downloads when we get interrupted
+	cancelDownloads(ctx)
+
+	// fill parameters through env, so warm can run with the same environment as build
+	if cmd.Dockerfile == "" && len(cmd.Images) == 0 {
+		cmd.Dockerfile = os.Getenv("DOCKERLESS_DOCKERFILE")
+		if cmd.Dockerfile == "" {
+			return fmt.Errorf("either --dockerfile or --image is required")
+		}
+	}
+	if cmd.Target == "" {
+		cmd.Target = os.Getenv("DOCKERLESS_TARGET")
+	}
+	buildArgs, err := resolveBuildArgs(nil, cmd.BuildArgs, cmd.BuildArgFiles)
+	if err != nil {
+		return err
+	}
+	cmd.BuildArgs = buildArgs
+	if cmd.Parallelism < 1 {
+		return fmt.Errorf("invalid --parallelism %d: must be at least 1", cmd.Parallelism)
+	}
+
+	cmd.Platform, err = resolvePlatform(cmd.Platform)
+	if err != nil {
+		return err
+	}
+	cmd.CacheTTL, err = resolveCacheTTL(cmd.CacheTTL)
+	if err != nil {
+		return err
+	}
+	err = cmd.parseRegistryOptions()
+	if err != nil {
+		return err
+	}
+
+	// collect the images to warm
+	images := cmd.Images
+	if cmd.Dockerfile != "" {
+		baseImages, err := cmd.dockerfileBaseImages()
+		if err != nil {
+			return fmt.Errorf("get base images of %s: %w", cmd.Dockerfile, err)
+		}
+
+		images = append(images, baseImages...)
+	}
+	images, err = dedupImages(images)
+	if err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		fmt.Println("nothing to warm, because the Dockerfile has no base images")
+		return nil
+	}
+
+	err = os.MkdirAll(cmd.CacheDir, 0755)
+	if err != nil {
+		return fmt.Errorf("create cache dir: %w", err)
+	}
+
+	// fetch all images in parallel
+	opts := &config.WarmerOptions{
+		CacheOptions: config.CacheOptions{
+			CacheDir: cmd.CacheDir,
+			CacheTTL: cmd.CacheTTL,
+		},
+		RegistryOptions: cmd.registryOptions(),
+		CustomPlatform:  cmd.Platform,
+	}
+	failed := 0
+	m := sync.Mutex{}
+	group := errgroup.Group{}
+	group.SetLimit(cmd.Parallelism)
+	for _, image := range images {
+		image := image
+		group.Go(func() error {
+			digest, err := cmd.warmImage(image, opts)
+			if cache.IsAlreadyCached(err) {
+				fmt.Printf("%s is already cached\n", image)
+				return nil
+			} else if err != nil {
+				fmt.Printf("warning: warm %s: %v\n", image, err)
+				m.Lock()
+				failed++
+				m.Unlock()
+				return nil
+			}
+
+			fmt.Printf("warmed %s (%s)\n", image, digest)
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	if failed == len(images) {
+		return ErrWarmFailed
+	}
+
+	return nil
+}
+
+// warmImage writes image to the cache dir. The tarball is written to a temporary file
+// first, so a concurrent build never picks up a partially written image.
+func (cmd *WarmCmd) warmImage(image string, opts *config.WarmerOptions) (v1.Hash, error) {
+	tarFile, err := os.CreateTemp(cmd.CacheDir, ".warm-*")
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tarFile.Name())
+	defer tarFile.Close()
+
+	manifest := &bytes.Buffer{}
+	warmer := &cache.Warmer{
+		Remote:         image_remote.RetrieveRemoteImage,
+		Local:          cmd.localSource,
+		TarWriter:      tarFile,
+		ManifestWriter: manifest,
+	}
+	digest, err := warmer.Warm(image, opts)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	err = tarFile.Close()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("write image: %w", err)
+	}
+
+	// the manifest is optional for kaniko, so we write it before the tarball becomes visible
+	cachePath := filepath.Join(cmd.CacheDir, digest.String())
+	err = writeStateFile(cachePath+".json", manifest.Bytes())
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("write manifest: %w", err)
+	}
+
+	err = os.Rename(tarFile.Name(), cachePath)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("move image into cache: %w", err)
+	}
+
+	return digest, nil
+}
+
+// localSource looks up an image in the cache. kaniko never refreshes expired images,
+// so with --force we pretend they do not exist.
+func (cmd *WarmCmd) localSource(opts *config.CacheOptions, cacheKey string) (v1.Image, error) {
+	image, err := cache.LocalSource(opts, cacheKey)
+	if cmd.Force && cache.IsExpired(err) {
+		return nil, cache.NotFoundErr{}
+	}
+
+	return image, err
+}
+
+// dockerfileBaseImages returns the remote base images of all stages that would be built
+func (cmd *WarmCmd) dockerfileBaseImages() ([]string, error) {
+	opts := &config.KanikoOptions{
+		DockerfilePath:   cmd.Dockerfile,
+		BuildArgs:        cmd.BuildArgs,
+		Target:           cmd.Target,
+		SkipUnusedStages: true,
+	}
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	if err != nil {
+		return nil, fmt.Errorf("parse dockerfile: %w", err)
+	}
+
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	if err != nil {
+		return nil, fmt.Errorf("resolve stages: %w", err)
+	}
+
+	images := []string{}
+	for _, stage := range kanikoStages {
+		if stage.BaseImageStoredLocally || stage.BaseName == constants.NoBaseImage {
+			continue
+		}
+
+		images = append(images, stage.BaseName)
+	}
+
+	return images, nil
+}
+
+// dedupImages removes images that reference the same image, e.g. ubuntu and docker.io/library/ubuntu:latest
+func dedupImages(images []string) ([]string, error) {
+	seen := map[string]bool{}
+	deduped := []string{}
+	for _, image := range images {
+		ref, err := name.ParseReference(image, name.WeakValidation)
+		if err != nil {
+			return nil, fmt.Errorf("parse image %s: %w", image, err)
+		} else if seen[ref.Name()] {
+			continue
+		}
+
+		seen[ref.Name()] = true
+		deduped = append(deduped, image)
+	}
+
+	return deduped, nil
+}
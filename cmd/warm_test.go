@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestDedupImages(t *testing.T) {
+	got, err := dedupImages([]string{"ubuntu", "docker.io/library/ubuntu:latest", "index.docker.io/library/ubuntu", "ubuntu:22.04", "ghcr.io/loft-sh/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"ubuntu", "ubuntu:22.04", "ghcr.io/loft-sh/app"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	_, err = dedupImages([]string{"UPPERCASE/Image"})
+	if err == nil {
+		t.Fatal("expected error for invalid image")
+	}
+}
+
+func TestDockerfileBaseImages(t *testing.T) {
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	writeFile(t, dockerfile, `ARG BASE=ubuntu
+FROM $BASE AS base
+FROM golang:1.22 AS build
+FROM base AS dev
+COPY --from=build /go /go
+FROM alpine AS unused
+FROM scratch AS final
+COPY --from=dev /go /go
+`)
+
+	tests := []struct {
+		name      string
+		target    string
+		buildArgs []string
+		want      []string
+	}{
+		{name: "default target", want: []string{"ubuntu", "golang:1.22"}},
+		{name: "build arg", target: "dev", buildArgs: []string{"BASE=debian"}, want: []string{"debian", "golang:1.22"}},
+		{name: "single stage", target: "unused", want: []string{"alpine"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := &WarmCmd{Dockerfile: dockerfile, Target: test.target, BuildArgs: test.buildArgs}
+			got, err := cmd.dockerfileBaseImages()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestWarmImage(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	image := strings.TrimPrefix(server.URL, "http://") + "/base:latest"
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remote.Write(ref, testImage(t, map[string]string{"etc/hello": "world"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &WarmCmd{CacheDir: t.TempDir(), CacheTTL: defaultCacheTTL}
+	cmd.InsecureRegistries = []string{ref.Context().RegistryStr()}
+	opts := &config.WarmerOptions{
+		CacheOptions:    config.CacheOptions{CacheDir: cmd.CacheDir, CacheTTL: cmd.CacheTTL},
+		RegistryOptions: cmd.registryOptions(),
+	}
+
+	digest, err := cmd.warmImage(image, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(cmd.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{digest.String(), digest.String() + ".json"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected cache dir to contain %v, got %v", want, names)
+	}
+
+	_, err = cmd.warmImage(image, opts)
+	if !cache.IsAlreadyCached(err) {
+		t.Fatalf("expected image to be cached, got %v", err)
+	}
+}